@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+)
+
+// apiAttachment is the JSON representation of one attachment of a mail.
+type apiAttachment struct {
+	Index       int    `json:"index"`
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	URL         string `json:"url"`
+}
+
+// apiMail is the JSON representation of a mail as returned by
+// APIMailController.  “HTML” contains only the content of the <body> element.
+type apiMail struct {
+	HashID      hashID          `json:"hashID"`
+	MessageID   messageID       `json:"messageID"`
+	URL         string          `json:"url"`
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Cc          string          `json:"cc,omitempty"`
+	Subject     string          `json:"subject"`
+	Date        time.Time       `json:"date"`
+	Text        string          `json:"text"`
+	HTML        string          `json:"html,omitempty"`
+	Attachments []apiAttachment `json:"attachments"`
+	Thread      *threadNode     `json:"thread,omitempty"`
+}
+
+// apiMailInfo is the JSON representation of a mailInfo, i.e. a row in the list
+// of the user’s mails.
+type apiMailInfo struct {
+	HashID         hashID         `json:"hashID"`
+	MessageID      messageID      `json:"messageID"`
+	From           string         `json:"from"`
+	Subject        string         `json:"subject"`
+	Folder         string         `json:"folder"`
+	Date           time.Time      `json:"date"`
+	HasAttachments bool           `json:"hasAttachments"`
+	FullThreadURL  string         `json:"fullThreadURL"`
+	Matches        []addressMatch `json:"matches"`
+}
+
+// newAPIMailInfos converts the given rows to their JSON representation.  “root”
+// is the absolute URL of mail2web’s root.
+func newAPIMailInfos(rows []myMailsRow, root string) []apiMailInfo {
+	result := make([]apiMailInfo, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, apiMailInfo{
+			HashID:         row.HashID,
+			MessageID:      row.MessageID,
+			From:           row.From,
+			Subject:        row.Subject,
+			Folder:         row.Folder,
+			Date:           row.Timestamp,
+			HasAttachments: row.HasAttachments,
+			FullThreadURL:  string(row.FullThreadLink(root)),
+			Matches:        row.Matches,
+		})
+	}
+	return result
+}
+
+type APIMailController struct {
+	web.Controller
+}
+
+// Controller for getting a particular email as JSON.  The token validation is
+// the same as for MainController.
+func (this *APIMailController) Get() {
+	accessMode, token, messageID, hashID, threadRoot, originHashID, message, link :=
+		getMailAndThreadRoot(&this.Controller)
+	queryString := accessQueryString(accessMode, token)
+	root := publicRoot(this.Ctx)
+	date, _ := message.Date()
+	result := apiMail{
+		HashID:      hashID,
+		MessageID:   messageID,
+		URL:         fmt.Sprintf("%v/%v%v", root, link, queryString),
+		From:        message.GetHeader("From"),
+		To:          message.GetHeader("To"),
+		Cc:          message.GetHeader("Cc"),
+		Subject:     message.GetHeader("Subject"),
+		Date:        date,
+		Text:        message.Text,
+		Attachments: []apiAttachment{},
+	}
+	if message.HTML != "" {
+		body, err := getBody(message.HTML, root+"/"+link, string(queryString))
+		check(err)
+		result.HTML = body
+	}
+	for i, attachment := range message.Attachments {
+		result.Attachments = append(result.Attachments, apiAttachment{
+			Index:       i,
+			FileName:    attachment.FileName,
+			ContentType: attachment.ContentType,
+			Size:        len(attachment.Content),
+			URL:         fmt.Sprintf("%v/%v/%v%v", root, link, i, queryString),
+		})
+	}
+	if threadRoot != "" {
+		result.Thread = getThread(&this.Controller, accessMode, messageID, threadRoot, originHashID, queryString)
+	}
+	auditAccess(&this.Controller, messageID, "")
+	this.Data["json"] = result
+	err := this.ServeJSON()
+	check(err)
+}
+
+type APIMyMailsController struct {
+	web.Controller
+}
+
+// Controller for getting the mails of the logged-in user as JSON.
+func (this *APIMyMailsController) Get() {
+	loginName := getLogin(&this.Controller)
+	query := parseMyMailsQuery(&this.Controller)
+	allRows, err := getMyMails(loginName, query)
+	abortOnError(&this.Controller, err)
+	rows, _ := paginate(allRows, query.page)
+	this.Data["json"] = newAPIMailInfos(rows, publicRoot(this.Ctx))
+	err = this.ServeJSON()
+	check(err)
+}
+
+type APISearchController struct {
+	web.Controller
+}
+
+// Controller for searching the mails of the logged-in user.  The query
+// parameter “q” is searched for case-insensitively in the sender, the subject,
+// and the message ID.
+func (this *APISearchController) Get() {
+	loginName := getLogin(&this.Controller)
+	searchTerm := strings.ToLower(this.GetString("q"))
+	query := parseMyMailsQuery(&this.Controller)
+	allRows, err := getMyMails(loginName, query)
+	abortOnError(&this.Controller, err)
+	var rows []myMailsRow
+	for _, row := range allRows {
+		if strings.Contains(strings.ToLower(row.From), searchTerm) ||
+			strings.Contains(strings.ToLower(row.Subject), searchTerm) ||
+			strings.Contains(strings.ToLower(string(row.MessageID)), searchTerm) {
+			rows = append(rows, row)
+		}
+	}
+	rows, _ = paginate(rows, query.page)
+	this.Data["json"] = newAPIMailInfos(rows, publicRoot(this.Ctx))
+	err = this.ServeJSON()
+	check(err)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getAPIMail requests the given mail from the JSON API and decodes the
+// response.
+func getAPIMail(t *testing.T, path string) (status int, result map[string]interface{}) {
+	t.Helper()
+	response := serve(httptest.NewRequest(http.MethodGet, path, nil))
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+		t.Fatalf("%v: unexpected content type %q: %s", path, contentType, response.Body.Bytes())
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%v: invalid JSON: %v", path, err)
+	}
+	return response.Code, result
+}
+
+// threadMessageIDs returns the message IDs of all nodes of the given thread
+// from the JSON API, in pre-order.
+func threadMessageIDs(node map[string]interface{}) (messageIDs []string) {
+	messageID, _ := node["messageID"].(string)
+	messageIDs = append(messageIDs, messageID)
+	children, _ := node["children"].([]interface{})
+	for _, child := range children {
+		messageIDs = append(messageIDs, threadMessageIDs(child.(map[string]interface{}))...)
+	}
+	return
+}
+
+func TestAPIMailTokenModes(t *testing.T) {
+	hash := testHashID("reply1@example.com")
+	for _, test := range []struct {
+		name, query string
+		thread      []string
+	}{
+		{"single", "", nil},
+		{"direct", "?tokenDirect=" + makeToken("reply1@example.com", "direct", time.Time{}),
+			[]string{"root@example.com", "reply1@example.com"}},
+		{"older", "?tokenOlder=" + makeToken("reply1@example.com", "older", time.Time{}),
+			[]string{"root@example.com", "reply1@example.com"}},
+		{"full", "?tokenFull=" + makeToken("reply1@example.com", "full", time.Time{}),
+			[]string{"root@example.com", "reply1@example.com", "reply2@example.com", "reply3@example.com"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			status, result := getAPIMail(t, "/api/v1/mails/"+string(hash)+test.query)
+			if status != http.StatusOK {
+				t.Fatalf("status %v: %v", status, result)
+			}
+			if result["messageID"] != "reply1@example.com" || result["hashID"] != string(hash) {
+				t.Errorf("wrong mail: %v, %v", result["messageID"], result["hashID"])
+			}
+			thread, ok := result["thread"].(map[string]interface{})
+			if test.thread == nil {
+				if ok {
+					t.Errorf("thread in single mode: %v", thread)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("no thread: %v", result)
+			}
+			messageIDs := threadMessageIDs(thread)
+			if len(messageIDs) != len(test.thread) {
+				t.Fatalf("thread %v, expected %v", messageIDs, test.thread)
+			}
+			for i := range messageIDs {
+				if messageIDs[i] != test.thread[i] {
+					t.Errorf("thread %v, expected %v", messageIDs, test.thread)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIMailOtherMailOfThread(t *testing.T) {
+	hash := testHashID("reply1@example.com")
+	token := makeToken("reply1@example.com", "full", time.Time{})
+	status, result := getAPIMail(t, "/api/v1/mails/"+string(hash)+"/reply3@example.com?tokenFull="+token)
+	if status != http.StatusOK {
+		t.Fatalf("status %v: %v", status, result)
+	}
+	if result["messageID"] != "reply3@example.com" {
+		t.Errorf("wrong mail %v", result["messageID"])
+	}
+	status, result = getAPIMail(t, "/api/v1/mails/"+string(hash)+"/reply3@example.com")
+	if status != http.StatusForbidden {
+		t.Errorf("status %v for message ID in single mode: %v", status, result)
+	}
+}
+
+func TestAPIMailErrors(t *testing.T) {
+	hash := string(testHashID("reply1@example.com"))
+	for _, test := range []struct {
+		name, path string
+		status     int
+	}{
+		{"unknown hash", "/api/v1/mails/AAAAAAAAAA", http.StatusNotFound},
+		{"invalid token", "/api/v1/mails/" + hash + "?tokenFull=AAAAAAAAAA", http.StatusForbidden},
+		{"token of other mail", "/api/v1/mails/" + hash + "?tokenFull=" +
+			makeToken("reply2@example.com", "full", time.Time{}), http.StatusForbidden},
+		{"expired token", "/api/v1/mails/" + hash + "?tokenFull=" +
+			makeToken("reply1@example.com", "full", time.Now().AddDate(0, 0, -2)), http.StatusForbidden},
+		{"unknown message ID", "/api/v1/mails/" + hash + "/unknown@example.com?tokenFull=" +
+			makeToken("reply1@example.com", "full", time.Time{}), http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			status, result := getAPIMail(t, test.path)
+			if status != test.status {
+				t.Errorf("status %v, expected %v", status, test.status)
+			}
+			if result["status"] != float64(test.status) {
+				t.Errorf("status field %v, expected %v", result["status"], test.status)
+			}
+			if message, _ := result["error"].(string); message == "" {
+				t.Errorf("no error message: %v", result)
+			}
+		})
+	}
+}
+
+func TestAPIMailThreadSchema(t *testing.T) {
+	hash := testHashID("reply1@example.com")
+	status, result := getAPIMail(t, "/api/v1/mails/"+string(hash)+"?tokenFull="+
+		makeToken("reply1@example.com", "full", time.Time{}))
+	if status != http.StatusOK {
+		t.Fatalf("status %v: %v", status, result)
+	}
+	root := result["thread"].(map[string]interface{})
+	for _, field := range []string{"messageID", "from", "fromName", "subject", "date", "hasAttachments", "missing",
+		"origin", "link", "children"} {
+		if _, ok := root[field]; !ok {
+			t.Errorf("thread root lacks field %q: %v", field, root)
+		}
+	}
+	if root["fromName"] != "Alice" || root["missing"] != false || root["origin"] != false {
+		t.Errorf("wrong thread root: %v", root)
+	}
+	if date, err := time.Parse(time.RFC3339, root["date"].(string)); err != nil ||
+		!date.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong date %v", root["date"])
+	}
+	current := root["children"].([]interface{})[0].(map[string]interface{})
+	if current["messageID"] != "reply1@example.com" || current["origin"] != true {
+		t.Errorf("wrong origin node: %v", current)
+	}
+	if _, ok := current["link"]; ok {
+		t.Errorf("current mail has link %v", current["link"])
+	}
+	if link, _ := root["link"].(string); link != string(hash)+"/root@example.com?tokenFull="+
+		makeToken("reply1@example.com", "full", time.Time{}) {
+		t.Errorf("wrong link %q", link)
+	}
+}
+
+func TestAPIMyMails(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/restricted/my_mails?since=2024-01-01&order=asc", nil)
+	request.SetBasicAuth("alice", "")
+	response := serve(request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %v: %s", response.Code, response.Body.Bytes())
+	}
+	var rows []apiMailInfo
+	if err := json.Unmarshal(response.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].MessageID != "root@example.com" || rows[1].MessageID != "reply2@example.com" {
+		t.Fatalf("wrong mails: %v", rows)
+	}
+	if len(rows[0].Matches) != 1 || rows[0].Matches[0].Address != "alice@example.com" ||
+		rows[0].Matches[0].Roles[0] != "From" {
+		t.Errorf("wrong matches: %v", rows[0].Matches)
+	}
+	request = httptest.NewRequest(http.MethodGet, "/api/v1/restricted/my_mails?since=2024-01-01&order=desc", nil)
+	request.SetBasicAuth("alice", "")
+	response = serve(request)
+	rows = nil
+	if err := json.Unmarshal(response.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].MessageID != "reply2@example.com" || rows[1].MessageID != "root@example.com" {
+		t.Errorf("wrong descending order: %v", rows)
+	}
+	response = serve(httptest.NewRequest(http.MethodGet, "/api/v1/restricted/my_mails", nil))
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("status %v without login", response.Code)
+	}
+}
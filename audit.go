@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"go4.org/must"
+)
+
+const (
+	auditAllowed    = "allowed"
+	auditDenied     = "denied"
+	auditRedirected = "redirected"
+)
+
+// auditRecord is one line in the audit log.  “HashID” is the hash in the URL,
+// i.e. the link used, and “MessageID” the mail actually shown, which may be
+// a different one of the same thread.  The fields are public because they are
+// used in the HTML views.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Result     string    `json:"result"`
+	Reason     string    `json:"reason,omitempty"`
+	HashID     hashID    `json:"hashID,omitempty"`
+	AccessMode string    `json:"accessMode,omitempty"`
+	MessageID  messageID `json:"messageID,omitempty"`
+	Attachment string    `json:"attachment,omitempty"`
+	ClientIP   string    `json:"clientIP,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Login      string    `json:"login,omitempty"`
+	// OldKey is the fingerprint of the old secret key if the hash ID or
+	// the token were made with it.
+	OldKey string `json:"oldKey,omitempty"`
+}
+
+const (
+	// auditMaxSize is the size of the audit log in bytes after which it is
+	// rotated.
+	auditMaxSize = 10 << 20
+	// auditMaxFiles is the number of audit log files kept, including the
+	// current one.
+	auditMaxFiles = 10
+)
+
+var (
+	auditLogPath string
+	auditFile    *os.File
+	auditSize    int64
+	auditLock    sync.Mutex
+)
+
+// rotatedAuditLogPath returns the path of the audit log file with the given
+// number.  0 is the current file, higher numbers are older files.
+func rotatedAuditLogPath(number int) string {
+	if number == 0 {
+		return auditLogPath
+	}
+	return fmt.Sprintf("%v.%v", auditLogPath, number)
+}
+
+// rotateAuditLog renames the current audit log to “….1”, “….1” to “….2”
+// etc., and removes the oldest file.  The caller must hold the audit lock.
+func rotateAuditLog() error {
+	if auditFile != nil {
+		if err := auditFile.Close(); err != nil {
+			return err
+		}
+		auditFile = nil
+	}
+	for number := auditMaxFiles - 1; number > 0; number-- {
+		err := os.Rename(rotatedAuditLogPath(number-1), rotatedAuditLogPath(number))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAuditRecord appends the record to the audit log.  Errors are only
+// logged, so that failures of the audit log don’t make the mails
+// inaccessible.
+func writeAuditRecord(record auditRecord) {
+	data, err := json.Marshal(record)
+	check(err)
+	data = append(data, '\n')
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFile != nil && auditSize+int64(len(data)) > auditMaxSize {
+		if err := rotateAuditLog(); err != nil {
+			logger.Println("Could not rotate audit log:", err)
+		}
+	}
+	if auditFile == nil {
+		auditFile, err = os.OpenFile(auditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			logger.Println("Could not open audit log:", err)
+			return
+		}
+		info, err := auditFile.Stat()
+		check(err)
+		auditSize = info.Size()
+	}
+	n, err := auditFile.Write(data)
+	auditSize += int64(n)
+	if err != nil {
+		logger.Println("Could not write audit log:", err)
+	}
+}
+
+// requestLogin returns the login name of the current request, or an empty
+// string for anonymous requests.  In contrast to getLogin, it does not panic
+// outside the restricted endpoints.
+func requestLogin(controller *web.Controller) string {
+	login, _ := controller.Ctx.Input.GetData("login").(string)
+	return login
+}
+
+// accessModeName returns the name of the access mode as used in token
+// parameters and the admin pages, e.g. “full”.
+func accessModeName(accessMode int) string {
+	for name, mode := range accessModeNames {
+		if mode == accessMode {
+			return name
+		}
+	}
+	return ""
+}
+
+// requestEvent returns the kind of access of the current request for the
+// audit log, e.g. “view” or “attachment”.
+func requestEvent(controller *web.Controller) string {
+	path := controller.Ctx.Request.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/feed/"):
+		return "feed"
+	case strings.HasPrefix(path, "/events/"):
+		return "events"
+	case strings.HasPrefix(path, "/api/"):
+		return "api"
+	case strings.HasPrefix(path, "/restricted/request/"):
+		return "request"
+	case strings.HasPrefix(path, "/restricted/"):
+		parts := strings.Split(path, "/")
+		return parts[len(parts)-1]
+	case controller.Ctx.Input.Param(":cid") != "":
+		return "image"
+	case controller.Ctx.Input.Param(":index") != "":
+		return "attachment"
+	default:
+		return "view"
+	}
+}
+
+// newAuditRecord returns an audit record with the data of the current request
+// filled in.  The access mode is derived from the token parameter, if any.
+func newAuditRecord(controller *web.Controller, result string) auditRecord {
+	record := auditRecord{
+		Time:      time.Now(),
+		Event:     requestEvent(controller),
+		Result:    result,
+		HashID:    hashID(controller.Ctx.Input.Param(":hash")),
+		MessageID: messageIDfromURL(controller.Ctx.Input.Param(":messageid")),
+		ClientIP:  clientIP(controller.Ctx),
+		UserAgent: controller.Ctx.Input.UserAgent(),
+		Login:     requestLogin(controller),
+	}
+	record.OldKey, _ = controller.Ctx.Input.GetData("oldKey").(string)
+	if record.HashID != "" {
+		record.AccessMode = accessModeName(accessSingle)
+		for _, name := range []string{"direct", "older", "full"} {
+			if controller.GetString(tokenParameter(name)) != "" {
+				record.AccessMode = name
+			}
+		}
+	}
+	return record
+}
+
+// auditAccess records a successful access to the mail with the given message
+// ID.  “attachment” is the file name or content ID of a downloaded part, if
+// any.
+func auditAccess(controller *web.Controller, messageID messageID, attachment string) {
+	record := newAuditRecord(controller, auditAllowed)
+	record.MessageID = messageID
+	record.Attachment = attachment
+	writeAuditRecord(record)
+}
+
+// denyAccess logs the reason, records the denied access in the audit log and
+// in the metrics (with the format string as the reason label), and
+// aborts the request with the given HTTP status code.
+func denyAccess(controller *web.Controller, status string, format string, v ...interface{}) {
+	reason := fmt.Sprintf(format, v...)
+	check(logger.Output(2, reason))
+	deniedRequestsCounter.WithLabelValues(status, format).Inc()
+	record := newAuditRecord(controller, auditDenied)
+	record.Reason = reason
+	writeAuditRecord(record)
+	controller.Abort(status)
+}
+
+// readAuditLog returns all records of the audit log, oldest first, for which
+// the filter function returns true.  The files are opened under the audit
+// lock, but scanned without it, so that accesses to mails are not blocked
+// meanwhile.  Rotation renames the files, so the opened files stay valid.
+// Every file is read only up to its size at opening time, so that no record
+// is read half-written.
+func readAuditLog(filter func(auditRecord) bool) (records []auditRecord, err error) {
+	type auditLogFile struct {
+		file *os.File
+		size int64
+	}
+	var files []auditLogFile
+	defer func() {
+		for _, file := range files {
+			must.Close(file.file)
+		}
+	}()
+	auditLock.Lock()
+	for number := auditMaxFiles - 1; number >= 0; number-- {
+		file, err := os.Open(rotatedAuditLogPath(number))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			auditLock.Unlock()
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			must.Close(file)
+			auditLock.Unlock()
+			return nil, err
+		}
+		files = append(files, auditLogFile{file, info.Size()})
+	}
+	auditLock.Unlock()
+	for _, file := range files {
+		scanner := bufio.NewScanner(io.LimitReader(file.file, file.size))
+		for scanner.Scan() {
+			var record auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				logger.Println("Invalid line in audit log:", err)
+				continue
+			}
+			if filter(record) {
+				records = append(records, record)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+type AdminAuditController struct {
+	web.Controller
+}
+
+// Controller for querying the audit log.  With the query parameter “hash”, it
+// lists all accesses to any mail of the thread of this mail, newest first.
+// Optionally, “login” restricts the list to one user.
+func (this *AdminAuditController) Get() {
+	checkAdmin(&this.Controller)
+	this.TplName = "adminAudit.tpl"
+	hash := hashID(this.GetString("hash"))
+	login := this.GetString("login")
+	this.Data["hash"] = hash
+	this.Data["login"] = login
+	if hash == "" {
+		return
+	}
+	thread := collectThread(hash)
+	records, err := readAuditLog(func(record auditRecord) bool {
+		if login != "" && record.Login != login {
+			return false
+		}
+		return thread[record.HashID] || (record.MessageID != "" && thread[messageIDToHashID(record.MessageID)])
+	})
+	check(err)
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	this.Data["records"] = records
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/beego/beego/v2/server/web/context"
+	"go4.org/must"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The authentication modes, selected by M2W_AUTH_MODE.
+const (
+	// authBasicProxy trusts the login name in the “Authorization: Basic”
+	// header without checking the password.  The reverse proxy must do
+	// this.
+	authBasicProxy = "basic-proxy"
+	// authTrustedProxy takes the login name from a header set by the reverse
+	// proxy.  The proxy is identified by its IP address or a shared secret.
+	authTrustedProxy = "trusted-proxy"
+	// authHtpasswd checks HTTP Basic credentials against an htpasswd file
+	// with bcrypt hashes.
+	authHtpasswd = "htpasswd"
+	// authOIDC lets users log in at an OpenID Connect provider.
+	authOIDC = "oidc"
+)
+
+const (
+	sessionCookieName = "m2w_session"
+	oidcCookieName    = "m2w_oidc"
+	sessionDuration   = 12 * time.Hour
+	oidcLoginDuration = 10 * time.Minute
+	// proxySecretHeader is the header in which the reverse proxy sends the
+	// shared secret in trusted-proxy mode.
+	proxySecretHeader = "X-Mail2web-Proxy-Secret"
+)
+
+// authenticator checks the credentials of requests to the restricted
+// endpoints.
+type authenticator interface {
+	// authenticate returns the login name of the request, or an empty
+	// string if the credentials are missing or invalid.
+	authenticate(ctx *context.Context) string
+	// challenge answers a request without valid credentials.
+	challenge(ctx *context.Context)
+}
+
+var (
+	authMode string
+	auth     authenticator
+	// sessionsEnabled is true if logins are remembered in session cookies,
+	// i.e. if not the reverse proxy is responsible for authentication.
+	sessionsEnabled bool
+)
+
+// basicCredentials returns login name and password of the “Authorization:
+// Basic” header of the request.
+func basicCredentials(ctx *context.Context) (login, password string, ok bool) {
+	components := strings.Split(ctx.Input.Header("Authorization"), " ")
+	if len(components) != 2 || components[0] != "Basic" {
+		return "", "", false
+	}
+	rawField, err := base64.StdEncoding.DecodeString(components[1])
+	if err != nil {
+		return "", "", false
+	}
+	components = strings.SplitN(string(rawField), ":", 2)
+	if len(components) != 2 || components[0] == "" {
+		return "", "", false
+	}
+	return components[0], components[1], true
+}
+
+// basicChallenge asks the browser for HTTP Basic credentials.
+func basicChallenge(ctx *context.Context) {
+	ctx.Output.Header("WWW-Authenticate", `Basic realm="mail2web", charset="UTF-8"`)
+	writeError(ctx, http.StatusUnauthorized, "Please log in.")
+}
+
+// basicProxyAuthenticator implements authBasicProxy.
+type basicProxyAuthenticator struct{}
+
+func (basicProxyAuthenticator) authenticate(ctx *context.Context) string {
+	login, _, _ := basicCredentials(ctx)
+	return login
+}
+
+func (basicProxyAuthenticator) challenge(ctx *context.Context) {
+	basicChallenge(ctx)
+}
+
+// trustedProxyAuthenticator implements authTrustedProxy.  The login header is
+// accepted if the request comes directly from one of the proxy networks, or
+// carries the shared secret.
+type trustedProxyAuthenticator struct {
+	header  string
+	proxies []*net.IPNet
+	secret  string
+}
+
+func (authenticator trustedProxyAuthenticator) authenticate(ctx *context.Context) string {
+	trusted := authenticator.secret != "" &&
+		hmac.Equal([]byte(ctx.Input.Header(proxySecretHeader)), []byte(authenticator.secret))
+	if !trusted {
+		host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil {
+			for _, network := range authenticator.proxies {
+				if network.Contains(ip) {
+					trusted = true
+					break
+				}
+			}
+		}
+	}
+	if !trusted {
+		return ""
+	}
+	return ctx.Input.Header(authenticator.header)
+}
+
+func (trustedProxyAuthenticator) challenge(ctx *context.Context) {
+	writeError(ctx, http.StatusUnauthorized, "Please log in.")
+}
+
+// htpasswdAuthenticator implements authHtpasswd.  The file is re-read when it
+// changes.
+type htpasswdAuthenticator struct {
+	path    string
+	lock    sync.Mutex
+	modTime time.Time
+	hashes  map[string][]byte
+}
+
+// readHtpasswd reads the htpasswd file if it has changed.  Only bcrypt hashes
+// are supported.  The caller must hold the lock.
+func (authenticator *htpasswdAuthenticator) readHtpasswd() error {
+	info, err := os.Stat(authenticator.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(authenticator.modTime) {
+		return nil
+	}
+	file, err := os.Open(authenticator.path)
+	if err != nil {
+		return err
+	}
+	defer must.Close(file)
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		components := strings.SplitN(line, ":", 2)
+		if len(components) != 2 || !strings.HasPrefix(components[1], "$2") {
+			logger.Printf("Ignoring line in %v without bcrypt hash", authenticator.path)
+			continue
+		}
+		hashes[components[0]] = []byte(components[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	authenticator.hashes = hashes
+	authenticator.modTime = info.ModTime()
+	return nil
+}
+
+func (authenticator *htpasswdAuthenticator) authenticate(ctx *context.Context) string {
+	login, password, ok := basicCredentials(ctx)
+	if !ok {
+		return ""
+	}
+	authenticator.lock.Lock()
+	err := authenticator.readHtpasswd()
+	hash := authenticator.hashes[login]
+	authenticator.lock.Unlock()
+	if err != nil {
+		logger.Println("Could not read htpasswd file:", err)
+		return ""
+	}
+	if hash == nil || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		logger.Printf("Invalid password for user %v", login)
+		return ""
+	}
+	return login
+}
+
+func (*htpasswdAuthenticator) challenge(ctx *context.Context) {
+	basicChallenge(ctx)
+}
+
+// oidcAuthenticator implements authOIDC.  It uses the authorization code flow
+// and takes the login name from a claim returned by the userinfo endpoint.
+// The endpoints are discovered from the issuer on first use.
+type oidcAuthenticator struct {
+	issuer, clientID, clientSecret, claim string
+	lock                                  sync.Mutex
+	endpoints                             *oidcEndpoints
+}
+
+// oidcEndpoints is the part of the OpenID provider metadata needed by
+// mail2web.
+type oidcEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	Userinfo      string `json:"userinfo_endpoint"`
+}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// getJSON fetches the given URL and decodes the JSON response into “result”.
+func getJSON(request *http.Request, result interface{}) error {
+	response, err := oidcClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer must.Close(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned HTTP %v", request.URL, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// getEndpoints returns the endpoints of the OpenID provider.
+func (authenticator *oidcAuthenticator) getEndpoints() (*oidcEndpoints, error) {
+	authenticator.lock.Lock()
+	defer authenticator.lock.Unlock()
+	if authenticator.endpoints == nil {
+		request, err := http.NewRequest(http.MethodGet,
+			strings.TrimSuffix(authenticator.issuer, "/")+"/.well-known/openid-configuration", nil)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints oidcEndpoints
+		if err := getJSON(request, &endpoints); err != nil {
+			return nil, err
+		}
+		authenticator.endpoints = &endpoints
+	}
+	return authenticator.endpoints, nil
+}
+
+// The login with OIDC is done by OIDCLoginController and OIDCCallbackController,
+// and remembered in a session cookie.
+func (*oidcAuthenticator) authenticate(ctx *context.Context) string {
+	return ""
+}
+
+// challenge redirects browsers to the OIDC login.  API clients get HTTP 401.
+func (*oidcAuthenticator) challenge(ctx *context.Context) {
+	if wantsJSON(ctx) {
+		writeError(ctx, http.StatusUnauthorized, "Please log in.")
+		return
+	}
+	ctx.Redirect(http.StatusFound,
+		basePath(ctx)+"/auth/login?next="+url.QueryEscape(basePath(ctx)+ctx.Request.URL.RequestURI()))
+}
+
+// authKey returns a key derived from the secret key for the given purpose,
+// e.g. signing session cookies.
+func authKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// signValue returns the value together with its expiration time and an HMAC
+// signature, for use in cookies.
+func signValue(purpose, value string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, authKey(purpose))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedValue returns the value signed with signValue, if the signature
+// is valid and the value has not expired.
+func verifySignedValue(purpose, signed string) (value string, ok bool) {
+	index := strings.LastIndex(signed, ".")
+	if index < 0 {
+		return "", false
+	}
+	payload, signature := signed[:index], signed[index+1:]
+	mac := hmac.New(sha256.New, authKey(purpose))
+	mac.Write([]byte(payload))
+	if !hmac.Equal([]byte(signature), []byte(base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))) {
+		return "", false
+	}
+	components := strings.SplitN(payload, ".", 2)
+	if len(components) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(components[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	rawValue, err := base64.RawURLEncoding.DecodeString(components[0])
+	if err != nil {
+		return "", false
+	}
+	return string(rawValue), true
+}
+
+// setCookie sets a cookie restricted to mail2web’s URLs.  An empty value
+// deletes the cookie.
+func setCookie(ctx *context.Context, name, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     basePath(ctx) + "/",
+		Expires:  expires,
+		Secure:   requestScheme(ctx) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(ctx.ResponseWriter, cookie)
+}
+
+// startSession remembers the login in a session cookie.
+func startSession(ctx *context.Context, login string) {
+	expires := time.Now().Add(sessionDuration)
+	setCookie(ctx, sessionCookieName, signValue("session", login, expires), expires)
+}
+
+// sessionLogin returns the login name stored in the session cookie, or an
+// empty string.
+func sessionLogin(ctx *context.Context) string {
+	if !sessionsEnabled {
+		return ""
+	}
+	login, _ := verifySignedValue("session", ctx.GetCookie(sessionCookieName))
+	return login
+}
+
+// csrfToken returns the token which must be sent with all POST requests of the
+// given user to the restricted endpoints, either as form field “csrf” or in
+// the header “X-CSRF-Token”.
+func csrfToken(login string) string {
+	mac := hmac.New(sha256.New, authKey("csrf"))
+	mac.Write([]byte(login))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authFilter authenticates all requests to the restricted endpoints.  The
+// login name is stored in the context data “login”, see getLogin.  Requests
+// which may change state need a valid CSRF token.
+func authFilter(ctx *context.Context) {
+	login := sessionLogin(ctx)
+	if login == "" {
+		login = auth.authenticate(ctx)
+		if login == "" {
+			auth.challenge(ctx)
+			return
+		}
+		if sessionsEnabled {
+			startSession(ctx, login)
+		}
+	}
+	method := ctx.Request.Method
+	if method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions {
+		token := ctx.Input.Query("csrf")
+		if token == "" {
+			token = ctx.Input.Header("X-CSRF-Token")
+		}
+		if !hmac.Equal([]byte(token), []byte(csrfToken(login))) {
+			logger.Printf("Denied %v request of %v because of invalid CSRF token", method, login)
+			writeError(ctx, http.StatusForbidden, "The form has expired.  Please reload the page and try again.")
+			return
+		}
+	}
+	ctx.Input.SetData("login", login)
+}
+
+// safeRedirectTarget returns the given target if it is a local path, and the
+// “my mails” page otherwise.  This prevents open redirects.
+func safeRedirectTarget(ctx *context.Context, target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return basePath(ctx) + "/restricted/my_mails"
+	}
+	return target
+}
+
+type OIDCLoginController struct {
+	web.Controller
+}
+
+// Controller which redirects to the OpenID provider.  The query parameter
+// “next” is the URL to return to after the login.
+func (this *OIDCLoginController) Get() {
+	oidc, ok := auth.(*oidcAuthenticator)
+	if !ok {
+		this.Abort("404")
+	}
+	endpoints, err := oidc.getEndpoints()
+	if err != nil {
+		logger.Println("OIDC discovery failed:", err)
+		this.Abort("502")
+	}
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+	check(err)
+	state := hex.EncodeToString(randomBytes)
+	expires := time.Now().Add(oidcLoginDuration)
+	setCookie(this.Ctx, oidcCookieName,
+		signValue("oidc", state+" "+safeRedirectTarget(this.Ctx, this.GetString("next")), expires), expires)
+	parameters := url.Values{
+		"response_type": {"code"},
+		"client_id":     {oidc.clientID},
+		"redirect_uri":  {oidcRedirectURI(&this.Controller)},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+	}
+	this.Redirect(endpoints.Authorization+"?"+parameters.Encode(), http.StatusFound)
+}
+
+// oidcRedirectURI returns the URL of OIDCCallbackController.
+func oidcRedirectURI(controller *web.Controller) string {
+	return publicRoot(controller.Ctx) + "/auth/callback"
+}
+
+type OIDCCallbackController struct {
+	web.Controller
+}
+
+// Controller for the redirect back from the OpenID provider.  It exchanges the
+// code for an access token, gets the login name from the userinfo endpoint,
+// and starts the session.
+func (this *OIDCCallbackController) Get() {
+	oidc, ok := auth.(*oidcAuthenticator)
+	if !ok {
+		this.Abort("404")
+	}
+	stateAndTarget, ok := verifySignedValue("oidc", this.Ctx.GetCookie(oidcCookieName))
+	components := strings.SplitN(stateAndTarget, " ", 2)
+	if !ok || len(components) != 2 || this.GetString("state") != components[0] || this.GetString("code") == "" {
+		logger.Println("Invalid OIDC callback")
+		this.Abort("400")
+	}
+	setCookie(this.Ctx, oidcCookieName, "", time.Time{})
+	endpoints, err := oidc.getEndpoints()
+	if err != nil {
+		logger.Println("OIDC discovery failed:", err)
+		this.Abort("502")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {this.GetString("code")},
+		"redirect_uri":  {oidcRedirectURI(&this.Controller)},
+		"client_id":     {oidc.clientID},
+		"client_secret": {oidc.clientSecret},
+	}
+	request, err := http.NewRequest(http.MethodPost, endpoints.Token, strings.NewReader(form.Encode()))
+	check(err)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := getJSON(request, &tokenResponse); err != nil || tokenResponse.AccessToken == "" {
+		logger.Println("OIDC token request failed:", err)
+		this.Abort("502")
+	}
+	request, err = http.NewRequest(http.MethodGet, endpoints.Userinfo, nil)
+	check(err)
+	request.Header.Set("Authorization", "Bearer "+tokenResponse.AccessToken)
+	var userinfo map[string]interface{}
+	if err := getJSON(request, &userinfo); err != nil {
+		logger.Println("OIDC userinfo request failed:", err)
+		this.Abort("502")
+	}
+	login, _ := userinfo[oidc.claim].(string)
+	if login == "" {
+		logger.Printf("OIDC userinfo lacks claim %v", oidc.claim)
+		this.Abort("403")
+	}
+	startSession(this.Ctx, login)
+	this.Redirect(components[1], http.StatusFound)
+}
+
+type LogoutController struct {
+	web.Controller
+}
+
+// Controller for ending the session.
+func (this *LogoutController) Get() {
+	setCookie(this.Ctx, sessionCookieName, "", time.Time{})
+	this.Ctx.Output.Header("Content-Type", "text/plain; charset=utf-8")
+	err := this.Ctx.Output.Body([]byte("You have been logged out.\n"))
+	check(err)
+}
+
+// setUpAuthentication configures the authentication mode given in the
+// configuration and installs the filter for the restricted endpoints.  The
+// configuration must have been validated.
+func setUpAuthentication(config *config) {
+	authMode = config.AuthMode
+	switch authMode {
+	case authBasicProxy:
+		auth = basicProxyAuthenticator{}
+		logger.Println("Authentication is left to the reverse proxy; passwords are not checked")
+	case authTrustedProxy:
+		proxies, err := parseNetworks(config.AuthTrustedProxies)
+		check(err)
+		auth = trustedProxyAuthenticator{
+			header:  config.AuthUserHeader,
+			proxies: proxies,
+			secret:  config.AuthProxySecret,
+		}
+	case authHtpasswd:
+		authenticator := &htpasswdAuthenticator{path: config.AuthHtpasswd}
+		check(authenticator.readHtpasswd())
+		auth = authenticator
+		sessionsEnabled = true
+	case authOIDC:
+		auth = &oidcAuthenticator{
+			issuer:       config.OIDCIssuer,
+			clientID:     config.OIDCClientID,
+			clientSecret: config.OIDCClientSecret,
+			claim:        config.OIDCUserClaim,
+		}
+		sessionsEnabled = true
+	default:
+		logger.Panicf("invalid authentication mode %q", authMode)
+	}
+	web.InsertFilter("/restricted/*", web.BeforeRouter, authFilter)
+	web.InsertFilter("/api/v1/restricted/*", web.BeforeRouter, authFilter)
+}
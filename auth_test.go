@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// findCookie returns the cookie with the given name set by the response, or
+// nil.
+func findCookie(response *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// isSubscribed returns whether the user follows the thread of the given mail.
+func isSubscribed(login string, hashID hashID) bool {
+	thread := collectThread(hashID)
+	subscriptionsLock.RLock()
+	defer subscriptionsLock.RUnlock()
+	for _, subscription := range subscriptions {
+		if subscription.Login == login && thread[subscription.originHashID()] {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStateChangingGETOnlyConfirms(t *testing.T) {
+	root := testHashID("root@example.com")
+	path := "/restricted/" + string(testHashID("reply1@example.com")) + "/subscribe?tokenFull=" +
+		makeToken("reply1@example.com", "full", time.Time{})
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.SetBasicAuth("alice", "")
+	response := serve(request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %v: %s", response.Code, response.Body.Bytes())
+	}
+	if !strings.Contains(response.Body.String(), `name="csrf" value="`+csrfToken("alice")+`"`) {
+		t.Errorf("confirmation page lacks the CSRF token: %s", response.Body.Bytes())
+	}
+	if isSubscribed("alice", root) {
+		t.Fatal("GET request subscribed")
+	}
+	request = httptest.NewRequest(http.MethodPost, path, nil)
+	request.SetBasicAuth("alice", "")
+	if response := serve(request); response.Code != http.StatusForbidden {
+		t.Errorf("status %v for POST without CSRF token", response.Code)
+	}
+	if isSubscribed("alice", root) {
+		t.Fatal("POST request without CSRF token subscribed")
+	}
+	request = httptest.NewRequest(http.MethodPost, path, strings.NewReader("csrf="+csrfToken("alice")))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("alice", "")
+	if response := serve(request); response.Code != http.StatusOK {
+		t.Fatalf("status %v: %s", response.Code, response.Body.Bytes())
+	}
+	if !isSubscribed("alice", root) {
+		t.Fatal("POST request did not subscribe")
+	}
+	unsubscribe("alice", root)
+}
+
+// oidcProvider is a local stand-in for an OpenID Connect provider.  It issues
+// the access token “access” for the code “code”, and returns “alice” as the
+// login name for it.
+type oidcProvider struct {
+	t      *testing.T
+	server *httptest.Server
+}
+
+func (provider *oidcProvider) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	var result interface{}
+	switch request.URL.Path {
+	case "/.well-known/openid-configuration":
+		result = oidcEndpoints{
+			Authorization: provider.server.URL + "/authorize",
+			Token:         provider.server.URL + "/token",
+			Userinfo:      provider.server.URL + "/userinfo",
+		}
+	case "/token":
+		if request.PostFormValue("code") != "code" || request.PostFormValue("client_id") != "mail2web" ||
+			request.PostFormValue("client_secret") != "client secret" ||
+			request.PostFormValue("redirect_uri") != "http://example.com/auth/callback" {
+			provider.t.Errorf("invalid token request %v", request.PostForm)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result = map[string]string{"access_token": "access", "token_type": "Bearer"}
+	case "/userinfo":
+		if request.Header.Get("Authorization") != "Bearer access" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		result = map[string]string{"sub": "1", "preferred_username": "alice"}
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(writer).Encode(result); err != nil {
+		provider.t.Error(err)
+	}
+}
+
+// setUpOIDCProvider starts an OpenID Connect stand-in and switches mail2web
+// to the OIDC authentication for the duration of the test.
+func setUpOIDCProvider(t *testing.T) {
+	provider := &oidcProvider{t: t}
+	provider.server = httptest.NewServer(provider)
+	oldAuth, oldSessionsEnabled := auth, sessionsEnabled
+	auth = &oidcAuthenticator{issuer: provider.server.URL, clientID: "mail2web", clientSecret: "client secret",
+		claim: "preferred_username"}
+	sessionsEnabled = true
+	t.Cleanup(func() {
+		auth, sessionsEnabled = oldAuth, oldSessionsEnabled
+		provider.server.Close()
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	setUpOIDCProvider(t)
+	response := serve(httptest.NewRequest(http.MethodGet, "/restricted/my_mails", nil))
+	if response.Code != http.StatusFound ||
+		response.Header().Get("Location") != "/auth/login?next="+url.QueryEscape("/restricted/my_mails") {
+		t.Fatalf("no redirect to the login: %v %v", response.Code, response.Header().Get("Location"))
+	}
+	response = serve(httptest.NewRequest(http.MethodGet, "/auth/login?next=/restricted/my_mails", nil))
+	if response.Code != http.StatusFound {
+		t.Fatalf("status %v: %s", response.Code, response.Body.Bytes())
+	}
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Path != "/authorize" || location.Query().Get("client_id") != "mail2web" ||
+		location.Query().Get("redirect_uri") != "http://example.com/auth/callback" {
+		t.Errorf("wrong authorization URL %v", location)
+	}
+	state := location.Query().Get("state")
+	oidcCookie := findCookie(response, oidcCookieName)
+	if oidcCookie == nil {
+		t.Fatal("no OIDC cookie")
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/auth/callback?code=code&state=wrong", nil)
+	request.AddCookie(oidcCookie)
+	if response := serve(request); response.Code != http.StatusBadRequest {
+		t.Errorf("status %v for wrong state", response.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/auth/callback?code=code&state="+url.QueryEscape(state), nil)
+	request.AddCookie(oidcCookie)
+	response = serve(request)
+	if response.Code != http.StatusFound || response.Header().Get("Location") != "/restricted/my_mails" {
+		t.Fatalf("no redirect back: %v %v %s", response.Code, response.Header().Get("Location"),
+			response.Body.Bytes())
+	}
+	sessionCookie := findCookie(response, sessionCookieName)
+	if sessionCookie == nil {
+		t.Fatal("no session cookie")
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/api/v1/restricted/my_mails?since=2024-01-01", nil)
+	request.AddCookie(sessionCookie)
+	response = serve(request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %v with session: %s", response.Code, response.Body.Bytes())
+	}
+	var rows []apiMailInfo
+	if err := json.Unmarshal(response.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("wrong mails for alice: %v", rows)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config contains all settings of mail2web.  Every setting can be given in the
+// YAML configuration file (key in the “yaml” tag), in an environment variable
+// (“env” tag), and as a command line flag (the YAML key with dashes instead of
+// underscores).  Flags take precedence over environment variables, which take
+// precedence over the configuration file.  Lists are comma-separated in
+// environment variables and flags.  Settings with the “reload” tag can be
+// changed at runtime, see reloadConfig.
+type config struct {
+	// path is the path of the configuration file, or empty.
+	path string
+
+	MailDir             string   `yaml:"mail_dir" env:"MAILDIR" help:"root directory of the mail folders"`
+	MailFolders         []string `yaml:"mail_folders" env:"MAIL_FOLDERS" reload:"yes" help:"subdirectories of the mail directory that contain the mails"`
+	RootURL             string   `yaml:"root_url" env:"ROOT_URL" help:"URL prefix for all endpoints"`
+	PublicOrigin        string   `yaml:"public_origin" env:"M2W_PUBLIC_ORIGIN" help:"scheme and host for absolute URLs"`
+	SecretKeyPath       string   `yaml:"secret_key_path" env:"SECRET_KEY_PATH" help:"path to the file with the secret key"`
+	OldSecretKeyPaths   []string `yaml:"old_secret_key_paths" env:"M2W_OLD_SECRET_KEY_PATHS" help:"paths to files with previous secret keys"`
+	RedirectOldLinks    bool     `yaml:"redirect_old_links" env:"M2W_REDIRECT_OLD_LINKS" help:"redirect links with old keys to the current key"`
+	HashLength          int      `yaml:"hash_length" env:"M2W_HASH_LENGTH" help:"length of newly issued hash IDs and tokens"`
+	MinHashLength       int      `yaml:"min_hash_length" env:"M2W_MIN_HASH_LENGTH" help:"minimal length of accepted hash IDs and tokens"`
+	LogPath             string   `yaml:"log_path" env:"M2W_LOG_PATH" help:"directory of mail2web.log"`
+	StatePath           string   `yaml:"state_path" env:"M2W_STATE_PATH" help:"directory for persistent state"`
+	AuditLogPath        string   `yaml:"audit_log_path" env:"M2W_AUDIT_LOG_PATH" help:"path of the audit log"`
+	MyMailsDays         int      `yaml:"my_mails_days" env:"M2W_MY_MAILS_DAYS" reload:"yes" help:"number of days shown in “my mails”"`
+	SMTPHost            string   `yaml:"smtp_host" env:"M2W_SMTP_HOST" reload:"yes" help:"host and port of the SMTP server"`
+	SMTPEnvelopeSender  string   `yaml:"smtp_envelope_sender" env:"M2W_SMTP_ENVELOPE_SENDER" reload:"yes" help:"envelope sender of sent mails"`
+	RequestMailTemplate string   `yaml:"request_mail_template" env:"M2W_REQUEST_MAIL_TEMPLATE" reload:"yes" help:"path to the template of the mail about approved link requests"`
+	RateLimitPerIP      int      `yaml:"rate_limit_per_ip" env:"M2W_RATE_LIMIT_PER_IP" reload:"yes" help:"failed requests per minute after which a client is locked out"`
+	RateLimitGlobal     int      `yaml:"rate_limit_global" env:"M2W_RATE_LIMIT_GLOBAL" reload:"yes" help:"failed requests per minute after which all clients are locked out"`
+	RateLimitAllow      []string `yaml:"rate_limit_allow" env:"M2W_RATE_LIMIT_ALLOW" reload:"yes" help:"networks exempt from rate limiting"`
+	TrustedProxies      []string `yaml:"trusted_proxies" env:"M2W_TRUSTED_PROXIES" reload:"yes" help:"networks of the reverse proxies whose X-Forwarded headers are trusted"`
+	AuthMode            string   `yaml:"auth_mode" env:"M2W_AUTH_MODE" help:"authentication mode"`
+	AuthUserHeader      string   `yaml:"auth_user_header" env:"M2W_AUTH_USER_HEADER" help:"header with the login name in trusted-proxy mode"`
+	AuthTrustedProxies  []string `yaml:"auth_trusted_proxies" env:"M2W_AUTH_TRUSTED_PROXIES" help:"networks of the trusted proxies"`
+	AuthProxySecret     string   `yaml:"auth_proxy_secret" env:"M2W_AUTH_PROXY_SECRET" help:"shared secret of the trusted proxy"`
+	AuthHtpasswd        string   `yaml:"auth_htpasswd" env:"M2W_AUTH_HTPASSWD" help:"path to the htpasswd file"`
+	OIDCIssuer          string   `yaml:"oidc_issuer" env:"M2W_OIDC_ISSUER" help:"OpenID Connect issuer URL"`
+	OIDCClientID        string   `yaml:"oidc_client_id" env:"M2W_OIDC_CLIENT_ID" help:"OpenID Connect client ID"`
+	OIDCClientSecret    string   `yaml:"oidc_client_secret" env:"M2W_OIDC_CLIENT_SECRET" help:"OpenID Connect client secret"`
+	OIDCUserClaim       string   `yaml:"oidc_user_claim" env:"M2W_OIDC_USER_CLAIM" help:"claim containing the login name"`
+}
+
+// defaultConfig returns the configuration used for settings which are not
+// given anywhere.
+func defaultConfig() config {
+	return config{
+		MailDir:             "/var/lib/mails",
+		SecretKeyPath:       "/var/lib/mail2web_secrets/secret_key",
+		HashLength:          shortestHashLength,
+		MinHashLength:       shortestHashLength,
+		StatePath:           "/var/lib/mail2web",
+		MyMailsDays:         30,
+		SMTPHost:            "postfix:587",
+		RequestMailTemplate: "requestMail.tpl",
+		RateLimitPerIP:      20,
+		RateLimitGlobal:     200,
+		AuthMode:            authBasicProxy,
+		AuthUserHeader:      "X-Forwarded-User",
+		OIDCUserClaim:       "preferred_username",
+	}
+}
+
+// flagName returns the name of the command line flag for the config field.
+func flagName(field reflect.StructField) string {
+	return strings.ReplaceAll(field.Tag.Get("yaml"), "_", "-")
+}
+
+// setConfigValue sets the config field to the given string value, parsing it
+// according to the field’s type.
+func setConfigValue(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		value.SetBool(flag)
+	case reflect.Int:
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		value.SetInt(int64(number))
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		panic("unsupported config field type " + value.Kind().String())
+	}
+	return nil
+}
+
+// loadConfig reads the configuration from the file given by “-config” or
+// M2W_CONFIG (if any), the environment, and the command line arguments, and
+// validates it.
+func loadConfig(args []string) (*config, error) {
+	config, err := parseConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadKeyConfig reads the configuration like loadConfig, but validates only
+// the settings of the secret keys and the hash lengths.  It is used by
+// commands which don’t serve mails.
+func loadKeyConfig(args []string) (*config, error) {
+	config, err := parseConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	if problems := config.validateKeys(); len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// parseConfig reads the configuration like loadConfig, but does not validate
+// it.
+func parseConfig(args []string) (*config, error) {
+	config := defaultConfig()
+	configType := reflect.TypeOf(config)
+	flags := flag.NewFlagSet("mail2web", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("M2W_CONFIG"), "path to the YAML configuration file")
+	fieldsByFlag := make(map[string]int)
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		flags.String(flagName(field), "", fmt.Sprintf("%v (env %v)", field.Tag.Get("help"), field.Tag.Get("env")))
+		fieldsByFlag[flagName(field)] = i
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	config.path = *configPath
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return nil, fmt.Errorf("%v: %w", *configPath, err)
+		}
+	}
+	configValue := reflect.ValueOf(&config).Elem()
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if raw, ok := os.LookupEnv(field.Tag.Get("env")); ok && raw != "" {
+			if err := setConfigValue(configValue.Field(i), raw); err != nil {
+				return nil, fmt.Errorf("%v: %w", field.Tag.Get("env"), err)
+			}
+		}
+	}
+	var err error
+	flags.Visit(func(flag *flag.Flag) {
+		i, ok := fieldsByFlag[flag.Name]
+		if err != nil || !ok {
+			return
+		}
+		if setErr := setConfigValue(configValue.Field(i), flag.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%v: %w", flag.Name, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AuditLogPath == "" {
+		config.AuditLogPath = filepath.Join(config.StatePath, "audit.jsonl")
+	}
+	return &config, nil
+}
+
+// validateKeys checks the settings of the secret keys and the hash lengths.
+// It returns all problems found.
+func (config *config) validateKeys() (problems []string) {
+	fail := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+	if _, err := os.Stat(config.SecretKeyPath); err != nil {
+		fail("secret_key_path: %v", err)
+	}
+	for _, path := range config.OldSecretKeyPaths {
+		if _, err := os.Stat(path); err != nil {
+			fail("old_secret_key_paths: %v", err)
+		}
+	}
+	if config.HashLength < shortestHashLength || config.HashLength > fullHashLength {
+		fail("hash_length must be between %v and %v", shortestHashLength, fullHashLength)
+	}
+	if config.MinHashLength < shortestHashLength || config.MinHashLength > config.HashLength {
+		fail("min_hash_length must be between %v and hash_length", shortestHashLength)
+	}
+	return problems
+}
+
+// validate checks the configuration for consistency.  It returns all problems
+// found at once.
+func (config *config) validate() error {
+	problems := config.validateKeys()
+	fail := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+	if info, err := os.Stat(config.MailDir); err != nil {
+		fail("mail_dir: %v", err)
+	} else if !info.IsDir() {
+		fail("mail_dir: %v is not a directory", config.MailDir)
+	}
+	if len(config.MailFolders) == 0 {
+		fail("mail_folders must not be empty")
+	}
+	if config.RootURL != "" && (!strings.HasPrefix(config.RootURL, "/") || strings.HasSuffix(config.RootURL, "/")) {
+		fail("root_url must be empty or start with a slash and not end with a slash")
+	}
+	if config.PublicOrigin != "" {
+		origin, err := url.Parse(config.PublicOrigin)
+		if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == "" ||
+			strings.TrimSuffix(origin.Path, "/") != "" || origin.RawQuery != "" {
+			fail("public_origin must consist of scheme and host only, e.g. https://mails.example.com")
+		}
+	}
+	if _, err := os.Stat(config.RequestMailTemplate); err != nil {
+		fail("request_mail_template: %v", err)
+	}
+	for name, value := range map[string]int{"my_mails_days": config.MyMailsDays,
+		"rate_limit_per_ip": config.RateLimitPerIP, "rate_limit_global": config.RateLimitGlobal} {
+		if value <= 0 {
+			fail("%v must be a positive integer", name)
+		}
+	}
+	if config.SMTPHost == "" {
+		fail("smtp_host must not be empty")
+	}
+	if _, err := parseNetworks(config.RateLimitAllow); err != nil {
+		fail("rate_limit_allow: %v", err)
+	}
+	if _, err := parseNetworks(config.TrustedProxies); err != nil {
+		fail("trusted_proxies: %v", err)
+	}
+	if _, err := parseNetworks(config.AuthTrustedProxies); err != nil {
+		fail("auth_trusted_proxies: %v", err)
+	}
+	switch config.AuthMode {
+	case authBasicProxy:
+	case authTrustedProxy:
+		if len(config.AuthTrustedProxies) == 0 && config.AuthProxySecret == "" {
+			fail("auth_mode trusted-proxy needs auth_trusted_proxies or auth_proxy_secret")
+		}
+	case authHtpasswd:
+		if config.AuthHtpasswd == "" {
+			fail("auth_mode htpasswd needs auth_htpasswd")
+		}
+	case authOIDC:
+		if config.OIDCIssuer == "" || config.OIDCClientID == "" {
+			fail("auth_mode oidc needs oidc_issuer and oidc_client_id")
+		}
+	default:
+		fail("invalid auth_mode %q", config.AuthMode)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyConfig(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "secret_key")
+	check(os.WriteFile(keyPath, []byte("secret"), 0o600))
+	args := []string{"-mail-dir", filepath.Join(dir, "missing"), "-secret-key-path", keyPath,
+		"-request-mail-template", filepath.Join(dir, "missing.tpl")}
+	if _, err := loadConfig(args); err == nil {
+		t.Error("loadConfig accepted a missing mail directory")
+	}
+	config, err := loadKeyConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AuditLogPath != filepath.Join(config.StatePath, "audit.jsonl") {
+		t.Errorf("wrong audit log path %v", config.AuditLogPath)
+	}
+	if _, err := loadKeyConfig(append(args, "-old-secret-key-paths", filepath.Join(dir, "missing"))); err == nil {
+		t.Error("loadKeyConfig accepted a missing old key")
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"html/template"
@@ -14,6 +13,7 @@ import (
 	"net/smtp"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -30,7 +30,11 @@ import (
 
 type typeHashID = hashID
 
-var requestMailTemplate *textTemplate.Template
+var (
+	requestMailTemplate      *textTemplate.Template
+	smtpHost, envelopeSender string
+	replyPrefixRegex         = regexp.MustCompile(`(?i)^(\s*(re|aw|fwd?|wg|sv|vs|antw)(\[\d+\])?\s*:)+`)
+)
 
 const (
 	accessSingle = iota
@@ -45,21 +49,14 @@ func check(e error) {
 	}
 }
 
-// getLogin takes the value of the HTTP “Authorization” header and returns the
-// login name found in it.
-func getLogin(authHeader string) (login string) {
-	components := strings.Split(authHeader, " ")
-	if len(components) != 2 || components[0] != "Basic" {
-		logger.Panic("Invalid Authorization header " + authHeader)
-	}
-	rawField, err := base64.StdEncoding.DecodeString(components[1])
-	check(err)
-	field := string(rawField)
-	components = strings.SplitN(field, ":", 2)
-	if len(components) != 2 {
-		logger.Panic("Invalid Authorization login+password string: " + field)
+// getLogin returns the login name of the current request to a restricted
+// endpoint, as determined by authFilter.
+func getLogin(controller *web.Controller) (login string) {
+	login, _ = controller.Ctx.Input.GetData("login").(string)
+	if login == "" {
+		logger.Panic("no login for restricted endpoint " + controller.Ctx.Request.URL.Path)
 	}
-	return components[0]
+	return login
 }
 
 // getBodyNode is taken from https://stackoverflow.com/a/38855264/188108 and a
@@ -107,7 +104,7 @@ func substituteImgSrcs(root *html.Node, urlPrefix, queryString string) {
 
 // getBody returns everything between <body>…</body> in the given HTML
 // document, or the empty string it it wasn’t found.  It is needed to embed
-// HTML mails in an HTML document.
+// HTML mails in an HTML document.  Citations and signatures are folded.
 //
 // BUG(bronger): We don’t do security sanitisation of the HTML here,
 // e.g. removing all JavaScript, or preventing CSS to leak to the surrounding
@@ -122,6 +119,7 @@ func getBody(htmlDocument string, urlPrefix, queryString string) (string, error)
 		return "", err
 	}
 	substituteImgSrcs(bodyNode, urlPrefix, queryString)
+	foldHTMLQuotes(bodyNode)
 	var buffer bytes.Buffer
 	writer := io.Writer(&buffer)
 	for child := bodyNode.FirstChild; child != nil; child = child.NextSibling {
@@ -207,8 +205,15 @@ func findThreadRoot(m *enmime.Envelope) (root hashID) {
 	if messageID == "" {
 		return ""
 	}
-	hashID := messageIDToHashID(messageID)
-	if raw, ok := cachedRoots.Load(hashID); ok {
+	return findThreadRootByHashID(messageIDToHashID(messageID))
+}
+
+// findThreadRootByHashID is like findThreadRoot but takes the hash ID of the
+// mail.
+func findThreadRootByHashID(hashID hashID) (root hashID) {
+	raw, ok := cachedRoots.Load(hashID)
+	countCacheLookup("thread_roots", ok)
+	if ok {
 		return raw.(typeHashID)
 	}
 	nodes := collectThread(hashID)
@@ -267,20 +272,30 @@ func findThreadRoot(m *enmime.Envelope) (root hashID) {
 }
 
 // threadNode represents one mail in a nested thread.  All members are
-// expotable because they are needed in the templates.
+// exportable because they are needed in the templates and in the JSON API.
+// “Missing” is true for fake thread roots, i.e. mails referenced by other
+// mails but not part of the mail archive.  “RepeatedSubject” is true if the subject is the same as the
+// parent’s one (apart from “Re:” prefixes).  “Origin” marks the origin mail.
 type threadNode struct {
-	MessageID     messageID
-	From, Subject string
-	RootURL       string
-	Link          template.URL
-	Children      []*threadNode
+	MessageID       messageID     `json:"messageID,omitempty"`
+	From            string        `json:"from"`
+	FromName        string        `json:"fromName"`
+	Subject         string        `json:"subject"`
+	Date            time.Time     `json:"date"`
+	HasAttachments  bool          `json:"hasAttachments"`
+	Missing         bool          `json:"missing"`
+	RepeatedSubject bool          `json:"-"`
+	Origin          bool          `json:"origin"`
+	RootURL         string        `json:"-"`
+	Link            template.URL  `json:"link,omitempty"`
+	Children        []*threadNode `json:"children,omitempty"`
 }
 
 // decodeRFC2047 returns the given raw mail header (RFC-2047-encoded and
 // quoted-printable) as a proper string.
 func decodeRFC2047(header string) string {
 	decoder := mime.WordDecoder{
-		func(charset string, input io.Reader) (io.Reader, error) {
+		CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
 			switch charset {
 			case "windows-1252", "cp1252":
 				return charmap.Windows1252.NewDecoder().Reader(input), nil
@@ -302,41 +317,81 @@ func decodeRFC2047(header string) string {
 	}
 }
 
+// senderName returns a short display name for the given (decoded) “From”
+// header, i.e. the name part of the address, or the local part of the address
+// if there is no name.
+func senderName(from string) string {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return from
+	}
+	if address.Name != "" {
+		return address.Name
+	}
+	return strings.SplitN(address.Address, "@", 2)[0]
+}
+
+// normalizeSubject returns the given subject without “Re:” and similar
+// prefixes, and without surrounding white space.  It is used to detect
+// repeated subjects in a thread.
+func normalizeSubject(subject string) string {
+	return strings.TrimSpace(replyPrefixRegex.ReplaceAllString(subject, ""))
+}
+
+// relativeTime returns the given time relative to now in a human-friendly
+// format, e.g. “3 hours ago”.  Times older than 30 days are returned as date,
+// and so are times more than a minute in the future (the sender’s clock was
+// wrong).  It is used in the views (templates).
+func relativeTime(timestamp time.Time) string {
+	if timestamp.IsZero() {
+		return ""
+	}
+	age := time.Since(timestamp)
+	switch {
+	case age < -time.Minute:
+		break
+	case age < time.Minute:
+		return "just now"
+	case age < 2*time.Minute:
+		return "1 minute ago"
+	case age < time.Hour:
+		return fmt.Sprintf("%d minutes ago", int(age.Minutes()))
+	case age < 2*time.Hour:
+		return "1 hour ago"
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%d hours ago", int(age.Hours()))
+	case age < 48*time.Hour:
+		return "yesterday"
+	case age <= thirtyDays:
+		return fmt.Sprintf("%d days ago", int(age.Hours()/24))
+	}
+	return timestamp.Format("2006-01-02")
+}
+
 // threadNodeByHashID returns the given message as a single threadNode,
 // i.e. the Children are not yet populated.  It handles the case the the hashID
 // points to a fake thread root, i.e. a mail that is references to by other
-// mails, but that is not part of the mail archive.
+// mails, but that is not part of the mail archive.  The data is taken from the
+// index, so no mail file is read.
 func threadNodeByHashID(hashID hashID) *threadNode {
-	mailPathsLock.RLock()
-	path := mailPaths[hashID]
-	mailPathsLock.RUnlock()
-	if path == "" {
+	mailInfosLock.RLock()
+	mailInfo, ok := mailInfos[hashID]
+	mailInfosLock.RUnlock()
+	if !ok {
 		return &threadNode{
-			From:    "unknown",
-			Subject: "unknown",
-			RootURL: rootURL,
+			From:     "unknown",
+			FromName: "unknown",
+			Subject:  "unknown",
+			Missing:  true,
 		}
 	}
-	file, err := os.Open(path)
-	check(err)
-	defer must.Close(file)
-	message, err := mail.ReadMessage(file)
-	var from, subject string
-	if err == nil {
-		from = decodeRFC2047(message.Header.Get("From"))
-		subject = decodeRFC2047(message.Header.Get("Subject"))
-	} else {
-		from = "unknown"
-		subject = "unknown"
-	}
-	messageID := extractMessageID(message.Header.Get("Message-ID"))
 	return &threadNode{
-		messageID,
-		from,
-		subject,
-		rootURL,
-		"",
-		nil,
+		MessageID:      mailInfo.MessageID,
+		From:           mailInfo.From,
+		FromName:       senderName(mailInfo.From),
+		Subject:        mailInfo.Subject,
+		Date:           mailInfo.Timestamp,
+		HasAttachments: mailInfo.HasAttachments,
 	}
 }
 
@@ -406,24 +461,32 @@ func messageIDfromURL(urlComponent string) messageID {
 	return messageID(strings.ReplaceAll(urlComponent, ">", "/"))
 }
 
+// mailLink returns the link (relative to the root URL, and without query
+// string) to the given mail, accessed through the given origin mail.
+func mailLink(originHashID hashID, messageID messageID) template.URL {
+	if hashMessageID(messageID, "") == originHashID {
+		return template.URL(originHashID)
+	}
+	return template.URL(fmt.Sprintf("%v/%v", originHashID, messageIDtoURL(messageID)))
+}
+
 // finalizeThread walks through a thread and removes the links (which is
 // identical to the hash ID since this is the only elements in the URL path)
 // from the node the hash ID of which matches the given one.  The reason is
 // that when displaying the thread in the browser, the current email should not
-// be hyperlinked.
-func finalizeThread(messageID messageID, originHashID hashID, thread *threadNode, queryString template.URL) *threadNode {
+// be hyperlinked.  Besides, it marks the origin mail and repeated subjects.
+func finalizeThread(messageID messageID, originHashID hashID, thread *threadNode, queryString template.URL,
+	root string) *threadNode {
+	thread.RootURL = root
 	if thread.MessageID == "" || thread.MessageID == messageID {
 		thread.Link = ""
 	} else {
-		if hashMessageID(thread.MessageID, "") == originHashID {
-			thread.Link = template.URL(originHashID)
-		} else {
-			thread.Link = template.URL(fmt.Sprintf("%v/%v", originHashID, messageIDtoURL(thread.MessageID)))
-		}
-		thread.Link += queryString
+		thread.Link = mailLink(originHashID, thread.MessageID) + queryString
 	}
+	thread.Origin = thread.MessageID != "" && hashMessageID(thread.MessageID, "") == originHashID
 	for _, child := range thread.Children {
-		finalizeThread(messageID, originHashID, child, queryString)
+		child.RepeatedSubject = normalizeSubject(child.Subject) == normalizeSubject(thread.Subject)
+		finalizeThread(messageID, originHashID, child, queryString, root)
 	}
 	return thread
 }
@@ -433,7 +496,9 @@ var envelopeCache sync.Map
 // readMail reads an RFC 5322 file and returns it as a mail object.  The
 // returned error is non-nil only if the mail file could not be found.
 func readMail(mailPath string) (message *enmime.Envelope, err error) {
-	if value, ok := envelopeCache.Load(mailPath); ok {
+	value, ok := envelopeCache.Load(mailPath)
+	countCacheLookup("envelopes", ok)
+	if ok {
 		return value.(*enmime.Envelope), nil
 	}
 	file, err := os.Open(mailPath)
@@ -448,6 +513,71 @@ func readMail(mailPath string) (message *enmime.Envelope, err error) {
 	return
 }
 
+// makeToken returns the token for the given message ID and access mode name
+// (“direct”, “older”, or “full”).  If “expires” is not zero, the token is
+// valid until the end of that day.  Such tokens are prefixed with the
+// expiration date, which is also salted into the hash.
+func makeToken(messageID messageID, name string, expires time.Time) string {
+	return makeTokenWithKey(secretKey, messageID, name, expires)
+}
+
+// makeTokenWithKey is like makeToken but uses the given secret key.
+func makeTokenWithKey(key []byte, messageID messageID, name string, expires time.Time) string {
+	prefix, salt := tokenSalt(name, expires)
+	return prefix + string(hashMessageIDWithKey(key, messageID, salt))
+}
+
+// tokenSalt returns the prefix of the token and the salt of its hash for the
+// given access mode name and expiration date.
+func tokenSalt(name string, expires time.Time) (prefix, salt string) {
+	if expires.IsZero() {
+		return "", name
+	}
+	date := expires.Format("20060102")
+	return date + ".", name + "/" + date
+}
+
+// tokenParameter returns the name of the query parameter for tokens of the
+// given access mode name, e.g. “tokenFull” for “full”.
+func tokenParameter(name string) string {
+	return "token" + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// tokenExpiry returns the expiration date of the token, or the zero time if
+// it does not expire.
+func tokenExpiry(token string) (time.Time, error) {
+	components := strings.SplitN(token, ".", 2)
+	if len(components) == 1 {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("20060102", components[0], time.Local)
+}
+
+// tokenKey returns the secret key with which the token was made for the given
+// message ID and access mode name, trying the current key first.  Tokens of
+// every length accepted by hashMatches are valid.  It returns nil if the token
+// is invalid or expired.
+func tokenKey(token string, messageID messageID, name string) []byte {
+	expires, err := tokenExpiry(token)
+	if err != nil {
+		return nil
+	}
+	if !expires.IsZero() && !time.Now().Before(expires.AddDate(0, 0, 1)) {
+		logger.Printf("Token %v for message ID %v has expired", token, messageID)
+		return nil
+	}
+	prefix, salt := tokenSalt(name, expires)
+	if !strings.HasPrefix(token, prefix) {
+		return nil
+	}
+	for _, key := range append([][]byte{secretKey}, oldSecretKeys...) {
+		if hashMatches(token[len(prefix):], fullHashWithKey(key, messageID, salt)) {
+			return key
+		}
+	}
+	return nil
+}
+
 // readOriginMail is a helper for getMailAndThreadRoot.  It returns hash ID,
 // message object, thread root ID, access mode (only one mail, whole thread
 // etc.) and token for the *origin* mail, i.e. the one given in the hash
@@ -460,20 +590,34 @@ func readOriginMail(controller *web.Controller) (
 	mailPathsLock.RLock()
 	mailPath := mailPaths[hashID]
 	mailPathsLock.RUnlock()
+	var oldKeyFingerprint string
+	if mailPath == "" {
+		if current, fingerprint, ok := resolveLegacyHashID(hashID); ok {
+			hashID, oldKeyFingerprint = current, fingerprint
+			mailPathsLock.RLock()
+			mailPath = mailPaths[hashID]
+			mailPathsLock.RUnlock()
+		}
+	}
 	message, err := readMail(mailPath)
 	if err != nil {
-		controller.Abort("404")
+		registerFailure(controller, "404")
+		denyAccess(controller, "404", "Denied access because hash ID %v is unknown", hashID)
 	}
 	messageID = extractMessageID(message.GetHeader("Message-ID"))
 	accessMode = accessSingle
 	scanForToken := func(name string) bool {
-		token = controller.GetString("token" + strings.Title(name))
+		token = controller.GetString(tokenParameter(name))
 		if token != "" {
-			if token != string(hashMessageID(messageID, name)) {
-				logger.Printf(
+			key := tokenKey(token, messageID, name)
+			if key == nil {
+				registerFailure(controller, "403")
+				denyAccess(controller, "403",
 					"Denied access because token %v is invalid for message ID %v and access mode %v",
 					token, messageID, name)
-				controller.Abort("403")
+			}
+			if !bytes.Equal(key, secretKey) {
+				oldKeyFingerprint = keyFingerprint(key)
 			}
 			return true
 		}
@@ -487,6 +631,9 @@ func readOriginMail(controller *web.Controller) (
 	case scanForToken("full"):
 		accessMode = accessFull
 	}
+	if oldKeyFingerprint != "" {
+		handleOldKey(controller, oldKeyFingerprint, hashID, messageID, accessMode, token)
+	}
 	if accessMode != accessSingle {
 		threadRoot = findThreadRoot(message)
 	}
@@ -508,8 +655,7 @@ func getMailAndThreadRoot(controller *web.Controller) (accessMode int, token str
 		var originThreadRoot typeHashID
 		originHashID, _, originThreadRoot, _, accessMode, token = readOriginMail(controller)
 		if accessMode == accessSingle {
-			logger.Println("Denied access because message ID parameter is forbidden for single access mode")
-			controller.Abort("403")
+			denyAccess(controller, "403", "Denied access because message ID parameter is forbidden for single access mode")
 		}
 		hashID = messageIDToHashID(messageID)
 		mailPathsLock.RLock()
@@ -518,7 +664,7 @@ func getMailAndThreadRoot(controller *web.Controller) (accessMode int, token str
 		var err error
 		message, err = readMail(mailPath)
 		if err != nil {
-			controller.Abort("404")
+			denyAccess(controller, "404", "Denied access because message ID %v is unknown", messageID)
 		}
 		if accessMode != accessSingle {
 			threadRoot = findThreadRoot(message)
@@ -533,10 +679,9 @@ func getMailAndThreadRoot(controller *web.Controller) (accessMode int, token str
 				if threadRootPath == "" {
 					threadRootPath = "<invalid hash ID!>"
 				}
-				logger.Printf(
+				denyAccess(controller, "403",
 					"Denied access because message ID %v and hash ID %v are different threads: %v, %v",
 					messageID, originHashID, originThreadRootPath, threadRootPath)
-				controller.Abort("403")
 			}
 		}
 		link = fmt.Sprintf("%v/%v", originHashID, messageIDtoURL(messageID))
@@ -552,6 +697,106 @@ func pathToLink(path string) string {
 	return folder + "/" + id
 }
 
+// conversationEntry represents one mail in the conversation view of a thread.
+// The public members are needed in the templates.
+type conversationEntry struct {
+	Link                template.URL
+	Anchor              string
+	From, Subject, Date string
+	Current             bool
+	HTML, Text          template.HTML
+	Attachments         []string
+	timestamp           time.Time
+}
+
+// flattenThread returns all nodes of the given thread in pre-order, i.e. in
+// the order they appear in the nested thread list.
+func flattenThread(thread *threadNode) (nodes []*threadNode) {
+	nodes = append(nodes, thread)
+	for _, child := range thread.Children {
+		nodes = append(nodes, flattenThread(child)...)
+	}
+	return
+}
+
+// buildConversation returns all mails of the given (already access-filtered)
+// thread as conversationEntry’s, ready to be rendered on one page.  If
+// treeOrder is false, the mails are sorted chronologically.  Thread nodes that
+// are not part of the mail archive are skipped.
+func buildConversation(thread *threadNode, messageID messageID, originHashID hashID,
+	queryString template.URL, treeOrder bool) (entries []conversationEntry) {
+	for _, node := range flattenThread(thread) {
+		if node.MessageID == "" {
+			continue
+		}
+		mailPathsLock.RLock()
+		path := mailPaths[messageIDToHashID(node.MessageID)]
+		mailPathsLock.RUnlock()
+		message, err := readMail(path)
+		if err != nil {
+			continue
+		}
+		link := mailLink(originHashID, node.MessageID)
+		entry := conversationEntry{
+			Link:    link,
+			Anchor:  string(messageIDToHashID(node.MessageID)),
+			From:    message.GetHeader("From"),
+			Subject: message.GetHeader("Subject"),
+			Date:    message.GetHeader("Date"),
+			Current: node.MessageID == messageID,
+		}
+		if message.HTML != "" {
+			body, err := getBody(message.HTML, thread.RootURL+"/"+string(link), string(queryString))
+			check(err)
+			entry.HTML = template.HTML(body)
+		} else {
+			entry.Text = foldQuotedText(message.Text)
+		}
+		for _, attachment := range message.Attachments {
+			entry.Attachments = append(entry.Attachments, attachment.FileName)
+		}
+		entry.timestamp, _ = mail.ParseDate(entry.Date)
+		entries = append(entries, entry)
+	}
+	if !treeOrder {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].timestamp.Before(entries[j].timestamp)
+		})
+	}
+	return
+}
+
+// accessQueryString returns the query string (including the “?”) which must
+// be appended to links to mails of the thread so that the given access mode
+// and token are retained.  For single access mode, it is empty.
+func accessQueryString(accessMode int, token string) template.URL {
+	var key string
+	switch accessMode {
+	case accessDirect:
+		key = "tokenDirect"
+	case accessOlder:
+		key = "tokenOlder"
+	case accessFull:
+		key = "tokenFull"
+	default:
+		return ""
+	}
+	return template.URL("?" + key + "=" + token)
+}
+
+// getThread returns the finalized thread for the data returned by
+// getMailAndThreadRoot.  It triggers an HTTP 403 if the selected mail is not
+// part of the thread allowed by the access mode.
+func getThread(controller *web.Controller, accessMode int, messageID messageID, threadRoot, originHashID hashID,
+	queryString template.URL) *threadNode {
+	thread, originIncluded := buildThread(threadRoot, originHashID, accessMode)
+	if !originIncluded {
+		denyAccess(controller, "403", "Denied access because selected mail %v is not included in allowed thread",
+			messageID)
+	}
+	return finalizeThread(messageID, originHashID, thread, queryString, basePath(controller.Ctx))
+}
+
 type MainController struct {
 	web.Controller
 }
@@ -560,42 +805,44 @@ type MainController struct {
 func (this *MainController) Get() {
 	accessMode, token, messageID, hashID, threadRoot, originHashID, message, link :=
 		getMailAndThreadRoot(&this.Controller)
-	var queryString template.URL
-	if accessMode != accessSingle {
-		var key string
-		switch accessMode {
-		case accessDirect:
-			key = "tokenDirect"
-		case accessOlder:
-			key = "tokenOlder"
-		case accessFull:
-			key = "tokenFull"
-		}
-		queryString = template.URL("?" + key + "=" + token)
+	queryString := accessQueryString(accessMode, token)
+	if queryString != "" {
 		this.Data["queryString"] = queryString
 	}
+	if accessMode == accessFull {
+		this.Data["feedLink"] = template.URL(fmt.Sprintf("%v/feed/%v%v", basePath(this.Ctx), originHashID, queryString))
+		this.Data["eventsLink"] = template.URL(fmt.Sprintf("%v/events/%v%v", basePath(this.Ctx), originHashID,
+			queryString))
+	}
+	var thread *threadNode
 	if threadRoot != "" {
-		thread, originIncluded := buildThread(threadRoot, originHashID, accessMode)
-		if !originIncluded {
-			logger.Printf("Denied access because selected mail %v is not included in allowed thread", messageID)
-			this.Abort("403")
-		}
-		this.Data["thread"] = finalizeThread(messageID, originHashID, thread, queryString)
+		thread = getThread(&this.Controller, accessMode, messageID, threadRoot, originHashID, queryString)
+		this.Data["thread"] = thread
+	}
+	auditAccess(&this.Controller, messageID, "")
+	if thread != nil && this.GetString("view") == "conversation" {
+		this.Data["conversation"] = buildConversation(
+			thread, messageID, originHashID, queryString, this.GetString("order") == "tree")
+		this.Data["rooturl"] = basePath(this.Ctx)
+		this.Data["link"] = template.URL(link)
+		this.Data["subject"] = message.GetHeader("Subject")
+		this.TplName = "conversation.tpl"
+		return
 	}
 	this.TplName = "index.tpl"
-	this.Data["rooturl"] = rootURL
+	this.Data["rooturl"] = basePath(this.Ctx)
 	this.Data["link"] = template.URL(link)
 	this.Data["from"] = message.GetHeader("From")
 	this.Data["subject"] = message.GetHeader("Subject")
 	this.Data["to"] = message.GetHeader("To")
 	this.Data["cc"] = message.GetHeader("Cc")
 	this.Data["date"] = message.GetHeader("Date")
-	this.Data["text"] = message.Text
+	this.Data["text"] = foldQuotedText(message.Text)
 	mailPathsLock.RLock()
 	path := mailPaths[hashID]
 	mailPathsLock.RUnlock()
 	this.Data["name"] = pathToLink(path)
-	body, err := getBody(message.HTML, rootURL+"/"+link, string(queryString))
+	body, err := getBody(message.HTML, basePath(this.Ctx)+"/"+link, string(queryString))
 	check(err)
 	this.Data["html"] = template.HTML(body)
 	var attachments []string
@@ -617,6 +864,8 @@ func (this *AttachmentController) Get() {
 	if index >= len(message.Attachments) {
 		this.Abort("404")
 	}
+	auditAccess(&this.Controller, extractMessageID(message.GetHeader("Message-ID")),
+		message.Attachments[index].FileName)
 	this.Ctx.Output.Header("Content-Disposition",
 		fmt.Sprintf("attachment; filename=\"%v\"", message.Attachments[index].FileName))
 	this.Ctx.Output.Header("Content-Type", message.Attachments[index].ContentType)
@@ -647,7 +896,7 @@ func getImage(message *enmime.Envelope, cid string) ([]byte, string, string, err
 			}
 		}
 	}
-	return nil, "", "", fmt.Errorf("image %v not found in email", cid)
+	return nil, "", "", newHTTPError(404, "Image %v not found in mail.", cid)
 }
 
 // Controller for downloading mail images.
@@ -655,7 +904,8 @@ func (this *ImageController) Get() {
 	_, _, _, _, _, _, message, _ := getMailAndThreadRoot(&this.Controller)
 	cid := this.Ctx.Input.Param(":cid")
 	content, contentType, filename, err := getImage(message, cid)
-	check(err)
+	abortOnError(&this.Controller, err)
+	auditAccess(&this.Controller, extractMessageID(message.GetHeader("Message-ID")), cid)
 	if filename == "" {
 		this.Ctx.Output.Header("Content-Disposition", "inline")
 	} else {
@@ -719,72 +969,257 @@ func filterHeaders(hashID hashID) []byte {
 	return append(bytes.Join(lines, []byte("\r\n")), []byte("\r\n")...)
 }
 
+// sendMail submits the given RFC 5322 mail to the configured SMTP host.
+func sendMail(recipients []string, content []byte) error {
+	settingsLock.RLock()
+	host, sender := smtpHost, envelopeSender
+	settingsLock.RUnlock()
+	err := smtp.SendMail(host, nil, sender, recipients, content)
+	countSMTPResult(err)
+	return err
+}
+
+// confirmAction renders a page which asks the user to confirm an action
+// changing state.  The form posts to the current URL, including its query
+// string, together with the CSRF token, so that the action itself is never
+// done by a GET request.
+func confirmAction(controller *web.Controller, title, question, button string) {
+	controller.TplName = "confirm.tpl"
+	controller.Data["title"] = title
+	controller.Data["question"] = question
+	controller.Data["button"] = button
+	controller.Data["csrf"] = csrfToken(getLogin(controller))
+}
+
 type SendController struct {
 	web.Controller
 }
 
-// Controller for getting the current email being sent to the logged-in person.
+// Controller for confirming that the current email should be sent to the
+// logged-in person.
 func (this *SendController) Get() {
-	loginName := getLogin(this.Ctx.Input.Header("Authorization"))
-	emailAddress := getEmailAddress(loginName)
-	if emailAddress == "" {
-		logger.Panicf("email address of %v not found", loginName)
-	}
-	_, _, _, hashID, _, _, _, _ := getMailAndThreadRoot(&this.Controller)
+	confirmAction(&this.Controller, "Send mail", "Send this mail to your email address?", "Send")
+}
+
+// Controller for getting the current email being sent to the logged-in person.
+func (this *SendController) Post() {
+	loginName := getLogin(&this.Controller)
+	emailAddress, err := userEmailAddress(loginName)
+	abortOnError(&this.Controller, err)
+	_, _, messageID, hashID, _, _, _, _ := getMailAndThreadRoot(&this.Controller)
 	mailBody := filterHeaders(hashID)
-	err := smtp.SendMail(os.Getenv("M2W_SMTP_HOST"), nil, os.Getenv("M2W_SMTP_ENVELOPE_SENDER"),
-		[]string{emailAddress}, mailBody)
-	check(err)
+	if err := sendMail([]string{emailAddress}, mailBody); err != nil {
+		logger.Printf("Could not send mail %v to %v: %v", hashID, emailAddress, err)
+		abortOnError(&this.Controller, newHTTPError(502, "The mail could not be sent.  Please try again later."))
+	}
+	auditAccess(&this.Controller, messageID, "")
 	this.Data["hash"] = hashID
 	this.Data["address"] = emailAddress
 	this.TplName = "sent.tpl"
-	this.Data["rooturl"] = rootURL
+	this.Data["rooturl"] = basePath(this.Ctx)
 }
 
 type MyMailsController struct {
 	web.Controller
 }
 
-// Controller for searching for mail by message ID/getting an emails by its message ID
-func (this *MyMailsController) Get() {
-	loginName := getLogin(this.Ctx.Input.Header("Authorization"))
-	emailAddress := getEmailAddress(loginName)
-	if emailAddress == "" {
-		logger.Panicf("email address of %v not found", loginName)
+// myMailsPageSize is the number of rows per page in the “my mails” page.
+const myMailsPageSize = 50
+
+// myMailsQuery contains the filters and the sorting for the list of the user’s
+// mails.  Zero values mean “no filter”.  “sortBy” may be “date”, “from”, or
+// “subject”.
+type myMailsQuery struct {
+	since, until    time.Time
+	folder, sender  string
+	attachmentsOnly bool
+	sortBy          string
+	ascending       bool
+	page            int
+}
+
+// parseMyMailsQuery reads the query parameters of the “my mails” page.  Dates
+// are given as YYYY-MM-DD.  If no dates are given, only the mails of the
+// default time window are shown.
+func parseMyMailsQuery(controller *web.Controller) (query myMailsQuery) {
+	parseDate := func(key string) time.Time {
+		raw := controller.GetString(key)
+		if raw == "" {
+			return time.Time{}
+		}
+		date, err := time.ParseInLocation("2006-01-02", raw, time.Local)
+		if err != nil {
+			controller.Abort("400")
+		}
+		return date
+	}
+	query.since = parseDate("since")
+	query.until = parseDate("until")
+	if !query.until.IsZero() {
+		query.until = query.until.AddDate(0, 0, 1)
+	}
+	if query.since.IsZero() && query.until.IsZero() {
+		settingsLock.RLock()
+		query.since = time.Now().Add(-myMailsWindow)
+		settingsLock.RUnlock()
+	}
+	query.folder = controller.GetString("folder")
+	query.sender = strings.ToLower(controller.GetString("sender"))
+	query.attachmentsOnly = controller.GetString("attachments") != ""
+	query.sortBy = controller.GetString("sort", "date")
+	if query.sortBy != "date" && query.sortBy != "from" && query.sortBy != "subject" {
+		controller.Abort("400")
+	}
+	query.ascending = controller.GetString("order") == "asc"
+	query.page, _ = controller.GetInt("page", 1)
+	if query.page < 1 {
+		query.page = 1
+	}
+	return
+}
+
+// matches returns whether the given mail passes the filters of the query.
+func (query myMailsQuery) matches(mail mailInfo) bool {
+	return (query.since.IsZero() || !mail.Timestamp.Before(query.since)) &&
+		(query.until.IsZero() || mail.Timestamp.Before(query.until)) &&
+		(query.folder == "" || mail.Folder == query.folder) &&
+		(query.sender == "" || strings.Contains(strings.ToLower(mail.From), query.sender)) &&
+		(!query.attachmentsOnly || mail.HasAttachments)
+}
+
+// addressMatch is one of the user’s addresses found in a mail, together with
+// the header fields it was found in.  It is used in the HTML views and thus
+// needs public fields.
+type addressMatch struct {
+	Address string   `json:"address"`
+	Roles   []string `json:"roles"`
+}
+
+// myMailsRow is a mail in the list of the user’s mails, together with the
+// user’s addresses found in it.
+type myMailsRow struct {
+	mailInfo
+	Matches []addressMatch
+}
+
+// getMyMails returns the mails of the given user matching the query, sorted
+// as requested by the query.  The mails of all addresses of the user are
+// included.  Paging is left to the caller.
+func getMyMails(loginName string, query myMailsQuery) ([]myMailsRow, error) {
+	emailAddresses := getEmailAddresses(loginName)
+	if len(emailAddresses) == 0 {
+		return nil, newHTTPError(403, "No mail address is configured for user %v.", loginName)
 	}
-	var rows []mailInfo
+	rowsByHashID := make(map[hashID]*myMailsRow)
+	var rows []*myMailsRow
 	mailsByAddressLock.RLock()
-	for _, mailInfo := range mailsByAddress[emailAddress] {
-		rows = append(rows, mailInfo)
+	for _, emailAddress := range emailAddresses {
+		emailAddress = strings.ToLower(emailAddress)
+		for hashID, mailInfo := range mailsByAddress[emailAddress] {
+			if !query.matches(mailInfo) {
+				continue
+			}
+			row := rowsByHashID[hashID]
+			if row == nil {
+				row = &myMailsRow{mailInfo: mailInfo}
+				rowsByHashID[hashID] = row
+				rows = append(rows, row)
+			}
+			row.Matches = append(row.Matches, addressMatch{emailAddress, mailInfo.roles[emailAddress]})
+		}
 	}
 	mailsByAddressLock.RUnlock()
-	logger.Println(len(rows))
+	less := func(i, j int) bool {
+		switch query.sortBy {
+		case "from":
+			return strings.ToLower(rows[i].From) < strings.ToLower(rows[j].From)
+		case "subject":
+			return normalizeSubject(rows[i].Subject) < normalizeSubject(rows[j].Subject)
+		default:
+			return rows[i].Timestamp.Before(rows[j].Timestamp)
+		}
+	}
 	sort.SliceStable(rows, func(i, j int) bool {
-		return rows[i].Timestamp.After(rows[j].Timestamp)
-	})
-	limit := len(rows)
-	for i, mail := range rows {
-		if time.Since(mail.Timestamp) > thirtyDays {
-			limit = i
-			break
+		if query.ascending {
+			return less(i, j)
 		}
+		return less(j, i)
+	})
+	result := make([]myMailsRow, len(rows))
+	for i, row := range rows {
+		result[i] = *row
+	}
+	return result, nil
+}
+
+// paginate returns the rows of the given page (1-based), and whether there
+// are further pages.
+func paginate(rows []myMailsRow, page int) (pageRows []myMailsRow, more bool) {
+	start := (page - 1) * myMailsPageSize
+	if start >= len(rows) {
+		return nil, false
+	}
+	end := start + myMailsPageSize
+	if end >= len(rows) {
+		return rows[start:], false
+	}
+	return rows[start:end], true
+}
+
+// Controller for searching for mail by message ID/getting an emails by its message ID
+func (this *MyMailsController) Get() {
+	loginName := getLogin(&this.Controller)
+	query := parseMyMailsQuery(&this.Controller)
+	allRows, err := getMyMails(loginName, query)
+	abortOnError(&this.Controller, err)
+	rows, more := paginate(allRows, query.page)
+	this.Data["rows"] = rows
+	parameters := this.Ctx.Request.URL.Query()
+	if query.page > 1 {
+		parameters.Set("page", strconv.Itoa(query.page-1))
+		this.Data["previousPage"] = template.URL("?" + parameters.Encode())
 	}
-	this.Data["rows"] = rows[:limit]
+	if more {
+		parameters.Set("page", strconv.Itoa(query.page+1))
+		this.Data["nextPage"] = template.URL("?" + parameters.Encode())
+	}
+	this.Data["page"] = query.page
+	settingsLock.RLock()
+	this.Data["folders"] = includedDirs
+	this.Data["windowDays"] = int(myMailsWindow.Hours() / 24)
+	settingsLock.RUnlock()
+	this.Data["since"] = this.GetString("since")
+	this.Data["until"] = this.GetString("until")
+	this.Data["folder"] = query.folder
+	this.Data["sender"] = this.GetString("sender")
+	this.Data["attachmentsOnly"] = query.attachmentsOnly
+	this.Data["sort"] = query.sortBy
+	this.Data["ascending"] = query.ascending
+	this.Data["addresses"] = strings.Join(getEmailAddresses(loginName), ", ")
 	this.TplName = "my_mails.tpl"
-	this.Data["rooturl"] = rootURL
+	this.Data["rooturl"] = basePath(this.Ctx)
 }
 
 type MailRequestController struct {
 	web.Controller
 }
 
-// Controller for requesting the hash of a certain email.
+// Controller for confirming the request of the hash of a certain email.
 func (this *MailRequestController) Get() {
-	loginName := getLogin(this.Ctx.Input.Header("Authorization"))
-	emailAddress := getEmailAddress(loginName)
-	if emailAddress == "" {
-		logger.Panicf("email address of %v not found", loginName)
-	}
+	messageID := messageIDfromURL(this.Ctx.Input.Param(":messageid"))
+	confirmAction(&this.Controller, "Mail request",
+		fmt.Sprintf("Request the link to the mail with the message ID %v?", messageID), "Request link")
+}
+
+// Controller for requesting the hash of a certain email.  If self-service
+// links are enabled in permissions.yaml and the user’s personal address occurs
+// in the mail, the links are shown immediately.  Otherwise, e.g. if the mail
+// was sent to a shared mailbox only, the request is queued for approval by the
+// administrator, who is notified by mail.
+func (this *MailRequestController) Post() {
+	loginName := getLogin(&this.Controller)
+	emailAddress, err := userEmailAddress(loginName)
+	abortOnError(&this.Controller, err)
 	messageID := messageIDfromURL(this.Ctx.Input.Param(":messageid"))
 	hashID := messageIDToHashID(messageID)
 	mailPathsLock.RLock()
@@ -794,7 +1229,9 @@ func (this *MailRequestController) Get() {
 		this.Abort("404")
 	}
 	file, err := os.Open(mailPath)
-	check(err)
+	if err != nil {
+		abortOnError(&this.Controller, newHTTPError(404, "The mail could not be read."))
+	}
 	defer must.Close(file)
 	message, err := mail.ReadMessage(file)
 	if err != nil {
@@ -819,40 +1256,66 @@ func (this *MailRequestController) Get() {
 	if !found {
 		this.Abort("403")
 	}
+	link := fmt.Sprintf("%v/%v", basePath(this.Ctx), hashID)
+	fullThreadLink := fmt.Sprintf("%v?tokenFull=%v", link, string(hashMessageID(messageID, "full")))
+	this.TplName = "mailRequest.tpl"
+	this.Data["messageid"] = messageID
+	if permissions.SelfServiceLinks && addresses[strings.ToLower(emailAddress)] {
+		auditAccess(&this.Controller, messageID, "")
+		this.Data["link"] = template.URL(link)
+		this.Data["fullThreadLink"] = template.URL(fullThreadLink)
+		return
+	}
 	adminMails := permissions.Addresses[permissions.Admin]
 	if len(adminMails) == 0 {
-		this.Abort("500")
+		abortOnError(&this.Controller, newHTTPError(500, "No administrator is configured."))
 	}
 	adminMail := adminMails[0]
-	link := fmt.Sprintf("%v/%v", rootURL, hashID)
-	fullThreadLink := fmt.Sprintf("%v?tokenFull=%v", link, string(hashMessageID(messageID, "full")))
-	mailContent := new(bytes.Buffer)
-	err = requestMailTemplate.Execute(mailContent, map[string]string{
-		"loginName": loginName, "link": link, "fullThreadLink": fullThreadLink})
-	check(err)
-	err = enmime.Builder().
+	request, isNew := addLinkRequest(loginName, messageID, hashID)
+	if !isNew {
+		return
+	}
+	mailContent := fmt.Sprintf("%v requests the link to the mail\n\n%v\n\n"+
+		"You can approve or deny the request at\n\n%v/restricted/admin/requests#%v\n",
+		loginName, messageID, mailRoot(this.Ctx), request.ID)
+	part, err := enmime.Builder().
 		From("", adminMail).
 		Subject("Request for hash ID for mail "+loginName).
 		ReplyTo("", emailAddress).
-		Text(mailContent.Bytes()).
-		To("", adminMail).Send(enmime.NewSMTP("postfix:587", nil))
+		Text([]byte(mailContent)).
+		To("", adminMail).Build()
 	check(err)
-	this.TplName = "mailRequest.tpl"
-	this.Data["messageid"] = messageID
-}
-
-type HealthController struct {
-	web.Controller
+	var content bytes.Buffer
+	err = part.Encode(&content)
+	check(err)
+	if err := sendMail([]string{adminMail}, content.Bytes()); err != nil {
+		logger.Printf("Could not notify the administrator about request %v: %v", request.ID, err)
+		abortOnError(&this.Controller, newHTTPError(502,
+			"Your request was stored, but the administrator could not be notified."))
+	}
 }
 
-// Controller for the /healthz endpoint.
-func (this *HealthController) Get() {
-	err := this.Ctx.Output.Body([]byte{})
-	check(err)
+// setUpMail takes the SMTP settings from the configuration and reads the
+// template of the mail about approved link requests.  If the template cannot
+// be read, nothing is changed.
+func setUpMail(config *config) error {
+	templateContent, err := os.ReadFile(config.RequestMailTemplate)
+	if err != nil {
+		return err
+	}
+	template, err := textTemplate.New("mail").Parse(string(templateContent))
+	if err != nil {
+		return err
+	}
+	settingsLock.Lock()
+	smtpHost = config.SMTPHost
+	envelopeSender = config.SMTPEnvelopeSender
+	requestMailTemplate = template
+	settingsLock.Unlock()
+	return nil
 }
 
 func init() {
-	templateContent, err := os.ReadFile("requestMail.tpl")
+	err := web.AddFuncMap("relativeTime", relativeTime)
 	check(err)
-	requestMailTemplate = textTemplate.Must(textTemplate.New("mail").Parse(string(templateContent)))
 }
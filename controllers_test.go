@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		name     string
+		age      time.Duration
+		expected string
+	}{
+		{"just now", 0, "just now"},
+		{"59 seconds", 59 * time.Second, "just now"},
+		{"one minute", time.Minute + time.Second, "1 minute ago"},
+		{"two minutes", 2*time.Minute + time.Second, "2 minutes ago"},
+		{"59 minutes", 59*time.Minute + time.Second, "59 minutes ago"},
+		{"one hour", time.Hour + time.Second, "1 hour ago"},
+		{"two hours", 2*time.Hour + time.Second, "2 hours ago"},
+		{"23 hours", 23*time.Hour + time.Second, "23 hours ago"},
+		{"one day", 24*time.Hour + time.Second, "yesterday"},
+		{"two days", 48*time.Hour + time.Second, "2 days ago"},
+		{"29 days", 29*24*time.Hour + time.Second, "29 days ago"},
+		{"31 days", 31 * 24 * time.Hour, now.Add(-31 * 24 * time.Hour).Format("2006-01-02")},
+		{"clock skew", -30 * time.Second, "just now"},
+		{"future", -2 * time.Hour, now.Add(2 * time.Hour).Format("2006-01-02")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if result := relativeTime(now.Add(-test.age)); result != test.expected {
+				t.Errorf("got %q, expected %q", result, test.expected)
+			}
+		})
+	}
+	if result := relativeTime(time.Time{}); result != "" {
+		t.Errorf("got %q for zero time", result)
+	}
+}
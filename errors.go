@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/beego/beego/v2/server/web/context"
+)
+
+// httpError is an error caused by the client or by an upstream service, as
+// opposed to a violated invariant.  It is reported to the client with the
+// given HTTP status code and message.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (err httpError) Error() string {
+	return err.message
+}
+
+// newHTTPError returns an httpError with the given status code and a message
+// which is shown to the client.
+func newHTTPError(status int, format string, v ...interface{}) error {
+	return httpError{status, fmt.Sprintf(format, v...)}
+}
+
+// abortOnError aborts the request if “err” is not nil.  httpError’s are shown
+// to the client by ErrorController.  All other errors are considered bugs and
+// cause a panic, like check does.
+func abortOnError(controller *web.Controller, err error) {
+	if err == nil {
+		return
+	}
+	var httpErr httpError
+	if !errors.As(err, &httpErr) {
+		logger.Panic(err)
+	}
+	check(logger.Output(2, fmt.Sprintf("HTTP %v: %v", httpErr.status, httpErr.message)))
+	controller.Ctx.Input.SetData("error", httpErr.message)
+	controller.Abort(strconv.Itoa(httpErr.status))
+}
+
+// writeError answers the request with an error page.  It is used in filters,
+// which cannot abort like controllers.
+func writeError(ctx *context.Context, status int, message string) {
+	ctx.Input.SetData("error", message)
+	web.Exception(uint64(status), ctx)
+}
+
+// wantsJSON returns whether the client should get errors as JSON, i.e. if it
+// is an API client.
+func wantsJSON(ctx *context.Context) bool {
+	return strings.HasPrefix(ctx.Request.URL.Path, "/api/") ||
+		strings.Contains(ctx.Input.Header("Accept"), "application/json")
+}
+
+// ErrorController renders the error pages for all HTTP errors, be it from
+// controller.Abort or from abortOnError.
+type ErrorController struct {
+	web.Controller
+}
+
+// renderError shows the error page with the message given by abortOnError, or
+// the default message for the status code.  API clients get JSON.
+func (this *ErrorController) renderError(status int) {
+	message, _ := this.Ctx.Input.GetData("error").(string)
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	if wantsJSON(this.Ctx) {
+		this.Data["json"] = map[string]interface{}{"status": status, "error": message}
+		err := this.ServeJSON()
+		check(err)
+		this.EnableRender = false
+		return
+	}
+	this.TplName = "error.tpl"
+	this.Data["status"] = status
+	this.Data["title"] = http.StatusText(status)
+	this.Data["message"] = message
+	this.Data["rooturl"] = basePath(this.Ctx)
+}
+
+func (this *ErrorController) Error400() { this.renderError(http.StatusBadRequest) }
+func (this *ErrorController) Error401() { this.renderError(http.StatusUnauthorized) }
+func (this *ErrorController) Error403() { this.renderError(http.StatusForbidden) }
+func (this *ErrorController) Error404() { this.renderError(http.StatusNotFound) }
+func (this *ErrorController) Error429() { this.renderError(http.StatusTooManyRequests) }
+func (this *ErrorController) Error500() { this.renderError(http.StatusInternalServerError) }
+func (this *ErrorController) Error502() { this.renderError(http.StatusBadGateway) }
+func (this *ErrorController) Error503() { this.renderError(http.StatusServiceUnavailable) }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+)
+
+// threadEvent describes a mail which was added to or removed from a thread.
+// “thread” contains the hash IDs of all mails in the thread, including the
+// added or removed one.
+type threadEvent struct {
+	removed bool
+	mailInfo
+	thread map[hashID]bool
+}
+
+var (
+	// threadSubscribers maps channels of subscribers to the root of the
+	// thread they are interested in.
+	threadSubscribers     = make(map[chan threadEvent]hashID)
+	threadSubscribersLock sync.RWMutex
+	// queuedThreadEvents passes the events from processUpdates to
+	// runThreadEventQueue, which queues webhooks and notifications.  Those
+	// write to disk and must not slow down processUpdates.
+	queuedThreadEvents = make(chan threadEvent, 100_000)
+)
+
+// subscribeThread returns a channel which receives all events concerning the
+// thread with the given root.  The channel must be released with
+// unsubscribeThread.
+func subscribeThread(root hashID) chan threadEvent {
+	events := make(chan threadEvent, 16)
+	threadSubscribersLock.Lock()
+	threadSubscribers[events] = root
+	threadSubscribersLock.Unlock()
+	return events
+}
+
+// unsubscribeThread releases a channel returned by subscribeThread.
+func unsubscribeThread(events chan threadEvent) {
+	threadSubscribersLock.Lock()
+	delete(threadSubscribers, events)
+	threadSubscribersLock.Unlock()
+}
+
+// threadEventsNeeded returns whether anyone is interested in thread events,
+// i.e. whether there are subscribers, webhooks, or users following threads.
+func threadEventsNeeded() bool {
+	threadSubscribersLock.RLock()
+	defer threadSubscribersLock.RUnlock()
+	return len(threadSubscribers) > 0 || webhooksConfigured() || subscriptionsExist()
+}
+
+// dispatchThreadEvent sends the given event to all subscribers of its thread,
+// and passes it on to runThreadEventQueue for the webhooks and notifications.
+// It is called by processUpdates and must not block, therefore, events are
+// dropped for subscribers that don’t keep up, and if the queue is full.  The
+// thread of the event is computed only if anyone is interested in it.
+func dispatchThreadEvent(event threadEvent) {
+	if !threadEventsNeeded() {
+		return
+	}
+	if event.thread == nil {
+		event.thread = collectThread(event.HashID)
+	}
+	threadSubscribersLock.RLock()
+	for events, root := range threadSubscribers {
+		if event.thread[root] {
+			select {
+			case events <- event:
+			default:
+				logger.Println("Dropped thread event for slow subscriber of thread", root)
+			}
+		}
+	}
+	threadSubscribersLock.RUnlock()
+	select {
+	case queuedThreadEvents <- event:
+	default:
+		logger.Println("Dropped thread event for webhooks and notifications of mail", event.HashID)
+	}
+}
+
+// runThreadEventQueue is a goroutine running for the whole run time of the
+// program.  It queues the webhooks and notifications matching the events
+// dispatched by dispatchThreadEvent.
+func runThreadEventQueue() {
+	for event := range queuedThreadEvents {
+		queueWebhooks(event)
+		queueNotifications(event)
+	}
+}
+
+// sseKeepAliveInterval is the interval in which comments are sent to the
+// browser so that proxies don’t close idle connections.
+const sseKeepAliveInterval = 30 * time.Second
+
+type EventsController struct {
+	web.Controller
+}
+
+// Controller for the Server-Sent Events of a full thread.  It needs a valid
+// “tokenFull” for the mail given by the hash.  Every mail added to or removed
+// from the thread results in an “added” or “removed” event with the hash ID,
+// sender, subject, and date of the mail as JSON data.
+func (this *EventsController) Get() {
+	_, _, threadRoot, messageID, accessMode, _ := readOriginMail(&this.Controller)
+	if accessMode != accessFull {
+		denyAccess(&this.Controller, "403", "Denied access to events because no tokenFull was given")
+	}
+	auditAccess(&this.Controller, messageID, "")
+	this.EnableRender = false
+	events := subscribeThread(threadRoot)
+	defer unsubscribeThread(events)
+	writer := this.Ctx.ResponseWriter
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	writer.Flush()
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.Ctx.Request.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			name := "added"
+			if event.removed {
+				name = "removed"
+			}
+			data, err := json.Marshal(map[string]interface{}{
+				"hashID":  event.HashID,
+				"from":    event.From,
+				"subject": event.Subject,
+				"date":    event.Timestamp,
+			})
+			check(err)
+			if _, err := fmt.Fprintf(writer, "event: %v\ndata: %s\n\n", name, data); err != nil {
+				return
+			}
+		}
+		writer.Flush()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+)
+
+// atomLink is a <link> element in an Atom feed.
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// atomAuthor is an <author> element in an Atom feed.
+type atomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+// atomEntry is one mail in an Atom feed.
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Link    atomLink   `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+// atomFeed is an Atom feed of a whole thread.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// feedSummaryLength is the maximal number of characters of the plain text
+// body used as the summary of a feed entry.
+const feedSummaryLength = 500
+
+// summarize returns the beginning of the given plain text mail body, without
+// quoted text and signatures.
+func summarize(text string) string {
+	var lines []string
+	for _, block := range splitTextBlocks(text) {
+		if block.kind == blockText {
+			lines = append(lines, block.lines...)
+		}
+	}
+	summary := []rune(strings.TrimSpace(strings.Join(lines, "\n")))
+	if len(summary) > feedSummaryLength {
+		return string(summary[:feedSummaryLength]) + " …"
+	}
+	return string(summary)
+}
+
+type FeedController struct {
+	web.Controller
+}
+
+// Controller for the Atom feed of a full thread.  It needs a valid “tokenFull”
+// for the mail given by the hash.  The entries are sorted newest first.  The
+// feed ID is derived from the origin mail rather than from the thread root,
+// because the root changes when an older mail of the thread arrives later.
+func (this *FeedController) Get() {
+	originHashID, _, threadRoot, messageID, accessMode, token := readOriginMail(&this.Controller)
+	if accessMode != accessFull {
+		denyAccess(&this.Controller, "403", "Denied access to feed because no tokenFull was given")
+	}
+	auditAccess(&this.Controller, messageID, "")
+	queryString := accessQueryString(accessMode, token)
+	root := publicRoot(this.Ctx)
+	var mailInfos_ []mailInfo
+	for hashID := range collectThread(threadRoot) {
+		mailInfosLock.RLock()
+		mailInfo, ok := mailInfos[hashID]
+		mailInfosLock.RUnlock()
+		if ok {
+			mailInfos_ = append(mailInfos_, mailInfo)
+		}
+	}
+	sort.Slice(mailInfos_, func(i, j int) bool {
+		return mailInfos_[i].Timestamp.After(mailInfos_[j].Timestamp)
+	})
+	feed := atomFeed{
+		ID: "urn:mail2web:thread:" + string(originHashID),
+		Links: []atomLink{
+			{Rel: "self", Href: root + this.Ctx.Request.URL.RequestURI()},
+			{Rel: "alternate", Type: "text/html",
+				Href: fmt.Sprintf("%v/%v%v", root, originHashID, queryString)},
+		},
+	}
+	for _, mailInfo := range mailInfos_ {
+		mailPathsLock.RLock()
+		path := mailPaths[mailInfo.HashID]
+		mailPathsLock.RUnlock()
+		var summary string
+		if message, err := readMail(path); err == nil {
+			summary = summarize(message.Text)
+		}
+		author := atomAuthor{Name: senderName(mailInfo.From)}
+		if address, err := mail.ParseAddress(mailInfo.From); err == nil {
+			author.Email = address.Address
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "urn:mail2web:" + string(mailInfo.HashID),
+			Title:   mailInfo.Subject,
+			Updated: mailInfo.Timestamp.Format(time.RFC3339),
+			Author:  author,
+			Link: atomLink{Rel: "alternate", Type: "text/html",
+				Href: fmt.Sprintf("%v/%v%v", root, mailLink(originHashID, mailInfo.MessageID), queryString)},
+			Summary: summary,
+		})
+	}
+	if len(mailInfos_) > 0 {
+		feed.Title = mailInfos_[len(mailInfos_)-1].Subject
+		feed.Updated = mailInfos_[0].Timestamp.Format(time.RFC3339)
+	} else {
+		feed.Updated = time.Now().Format(time.RFC3339)
+	}
+	content, err := xml.MarshalIndent(feed, "", "  ")
+	check(err)
+	this.Ctx.Output.Header("Content-Type", "application/atom+xml; charset=utf-8")
+	err = this.Ctx.Output.Body(append([]byte(xml.Header), content...))
+	check(err)
+}
@@ -6,7 +6,9 @@ require (
 	github.com/beego/beego/v2 v2.0.1
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/jhillyerd/enmime v1.2.0
+	github.com/prometheus/client_golang v1.7.0
 	go4.org v0.0.0-20230225012048-214862532bf5
+	golang.org/x/crypto v0.14.0
 	golang.org/x/exp v0.0.0-20230118134722-a68e582fa157
 	golang.org/x/net v0.17.0
 	golang.org/x/text v0.13.0
@@ -26,14 +28,12 @@ require (
 	github.com/mitchellh/mapstructure v1.3.3 // indirect
 	github.com/olekukonko/tablewriter v0.0.5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/prometheus/client_golang v1.7.0 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/prometheus/common v0.10.0 // indirect
 	github.com/prometheus/procfs v0.1.3 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
 	github.com/shiena/ansicolor v0.0.0-20151119151921-a422bbe96644 // indirect
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
-	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/mod v0.8.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/beego/beego/v2/server/web/context"
+)
+
+// indexingProgress counts the files of one run of populateGlobalMaps.
+// “filesFound” is the number of files found so far by walking the mail
+// folders, and “filesIndexed” the number of those already processed.
+type indexingProgress struct {
+	filesFound    atomic.Int64
+	filesIndexed  atomic.Int64
+	walkCompleted atomic.Bool
+}
+
+// The progress of the initial indexing.  Folders added at runtime are counted
+// separately, so that they don’t show up in /readyz.  “ready” is set when all
+// files are indexed and the resulting updates are processed.
+// “indexingStart” is set in main before the indexing and the web server are
+// started, and never changed afterwards.
+var (
+	initialIndexing  indexingProgress
+	indexingStart    time.Time
+	indexingDuration atomic.Int64
+	ready            atomic.Bool
+)
+
+// readiness is the JSON response of /readyz.
+type readiness struct {
+	Ready            bool      `json:"ready"`
+	IndexingStarted  time.Time `json:"indexingStarted"`
+	IndexingDuration float64   `json:"indexingDuration"`
+	WalkCompleted    bool      `json:"walkCompleted"`
+	FilesFound       int64     `json:"filesFound"`
+	FilesIndexed     int64     `json:"filesIndexed"`
+	QueuedUpdates    int       `json:"queuedUpdates"`
+	Quarantined      int       `json:"quarantined"`
+}
+
+// getReadiness returns the current progress of the indexing.  The duration is
+// in seconds; it is the time until now as long as the indexing lasts.
+func getReadiness() readiness {
+	result := readiness{
+		Ready:           ready.Load(),
+		IndexingStarted: indexingStart,
+		WalkCompleted:   initialIndexing.walkCompleted.Load(),
+		FilesFound:      initialIndexing.filesFound.Load(),
+		FilesIndexed:    initialIndexing.filesIndexed.Load(),
+		QueuedUpdates:   len(updates),
+	}
+	quarantinedMailsLock.RLock()
+	result.Quarantined = len(quarantinedMails)
+	quarantinedMailsLock.RUnlock()
+	if duration := indexingDuration.Load(); duration != 0 {
+		result.IndexingDuration = time.Duration(duration).Seconds()
+	} else {
+		result.IndexingDuration = time.Since(indexingStart).Seconds()
+	}
+	return result
+}
+
+// indexMails does the initial indexing of all mails.  When it is done, and
+// all updates resulting from it are processed, mail2web is ready for requests.
+// Folders which cannot be read are logged and skipped.
+func indexMails() {
+	settingsLock.RLock()
+	folders := includedDirs
+	settingsLock.RUnlock()
+	if err := populateGlobalMaps(folders, &initialIndexing); err != nil {
+		logger.Println("Initial indexing is incomplete:", err)
+	}
+	waitForUpdates()
+	indexingDuration.Store(int64(time.Since(indexingStart)))
+	ready.Store(true)
+	logger.Printf("Indexed %v files in %v", initialIndexing.filesIndexed.Load(), time.Since(indexingStart).Round(time.Millisecond))
+}
+
+// isMonitoringPath returns whether the path is one of the endpoints for
+// monitoring.  They are exempt from rate limiting and available during the
+// indexing.
+func isMonitoringPath(path string) bool {
+	switch path {
+	case "/healthz", "/livez", "/readyz", "/metrics":
+		return true
+	}
+	return false
+}
+
+// indexingFilter rejects all requests with HTTP 503 as long as the initial
+// indexing lasts, except for the monitoring endpoints.
+func indexingFilter(ctx *context.Context) {
+	if ready.Load() || isMonitoringPath(ctx.Request.URL.Path) {
+		return
+	}
+	ctx.Output.Header("Retry-After", "30")
+	writeError(ctx, http.StatusServiceUnavailable,
+		"mail2web is starting up and still indexing the mails ("+
+			strconv.FormatInt(initialIndexing.filesIndexed.Load(), 10)+" so far).  Please try again in a minute.")
+}
+
+type LivenessController struct {
+	web.Controller
+}
+
+// Controller for the /livez endpoint.  It returns HTTP 200 as long as the
+// server is running.
+func (this *LivenessController) Get() {
+	err := this.Ctx.Output.Body([]byte{})
+	check(err)
+}
+
+type ReadinessController struct {
+	web.Controller
+}
+
+// Controller for the /readyz endpoint.  It returns the indexing progress as
+// JSON, with HTTP 200 if mail2web is ready for requests, and HTTP 503
+// otherwise.
+func (this *ReadinessController) Get() {
+	readiness := getReadiness()
+	if !readiness.Ready {
+		this.Ctx.Output.SetStatus(http.StatusServiceUnavailable)
+	}
+	this.Data["json"] = readiness
+	err := this.ServeJSON()
+	check(err)
+}
+
+type HealthController struct {
+	web.Controller
+}
+
+// Controller for the /healthz endpoint.  It returns HTTP 200 if mail2web is
+// ready for requests, and HTTP 503 otherwise.
+func (this *HealthController) Get() {
+	if !ready.Load() {
+		this.Ctx.Output.SetStatus(http.StatusServiceUnavailable)
+	}
+	err := this.Ctx.Output.Body([]byte{})
+	check(err)
+}
+
+func init() {
+	web.InsertFilter("*", web.BeforeRouter, indexingFilter)
+}
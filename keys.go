@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+)
+
+// legacyHashID is the mail a hash ID with an old key or another length points
+// to.  “full” is the hash ID with fullHashLength characters.
+type legacyHashID struct {
+	current, full hashID
+	fingerprint   string
+}
+
+var (
+	// oldSecretKeys are the previous secret keys.  Hash IDs and tokens made
+	// with them are still accepted, but new ones are made with secretKey
+	// only.
+	oldSecretKeys [][]byte
+	// redirectOldLinks makes requests with old-key hash IDs or tokens
+	// redirect to the URL with the current key.
+	redirectOldLinks bool
+	// legacyHashIDs maps the first minHashLength characters of the hash IDs
+	// of every mail under all keys to the mail.
+	legacyHashIDs     = make(map[hashID]legacyHashID)
+	legacyHashIDsLock sync.RWMutex
+)
+
+// readSecretKey reads a secret key file.  White space around the key is
+// removed.
+func readSecretKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Trim(key, "\t\n\r\f\v "), nil
+}
+
+// readSecretKeys reads the current and the old secret keys given in the
+// configuration.
+func readSecretKeys(config *config) {
+	var err error
+	secretKey, err = readSecretKey(config.SecretKeyPath)
+	check(err)
+	oldSecretKeys = nil
+	for _, path := range config.OldSecretKeyPaths {
+		key, err := readSecretKey(path)
+		check(err)
+		oldSecretKeys = append(oldSecretKeys, key)
+	}
+	redirectOldLinks = config.RedirectOldLinks
+	hashLength = config.HashLength
+	minHashLength = config.MinHashLength
+}
+
+// keyFingerprint returns a short identifier of the key for logs and reports.
+// It does not reveal the key.
+func keyFingerprint(key []byte) string {
+	hash := sha256.Sum256(append([]byte("mail2web key fingerprint>"), key...))
+	return hex.EncodeToString(hash[:4])
+}
+
+// registerLegacyHashIDs makes the hash IDs of the message ID under all old
+// keys, as well as those under the current key but with another length than
+// hashLength, point to the current one.
+func registerLegacyHashIDs(messageID messageID, current hashID) {
+	legacyHashIDsLock.Lock()
+	defer legacyHashIDsLock.Unlock()
+	full := fullHashWithKey(secretKey, messageID, "")
+	legacyHashIDs[full[:minHashLength]] = legacyHashID{current, full, ""}
+	for _, key := range oldSecretKeys {
+		full := fullHashWithKey(key, messageID, "")
+		legacyHashIDs[full[:minHashLength]] = legacyHashID{current, full, keyFingerprint(key)}
+	}
+}
+
+// unregisterLegacyHashIDs removes the legacy hash IDs of the message ID.
+func unregisterLegacyHashIDs(messageID messageID) {
+	legacyHashIDsLock.Lock()
+	defer legacyHashIDsLock.Unlock()
+	for _, key := range append([][]byte{secretKey}, oldSecretKeys...) {
+		delete(legacyHashIDs, fullHashWithKey(key, messageID, "")[:minHashLength])
+	}
+}
+
+// resolveLegacyHashID returns the current hash ID for the given hash ID with
+// an old key or another length, and the fingerprint of the old key (empty for
+// the current key).  If the hash ID is unknown, “ok” is false.
+func resolveLegacyHashID(hashID hashID) (current hashID, fingerprint string, ok bool) {
+	if len(hashID) < minHashLength {
+		return "", "", false
+	}
+	legacyHashIDsLock.RLock()
+	legacy, ok := legacyHashIDs[hashID[:minHashLength]]
+	legacyHashIDsLock.RUnlock()
+	if !ok || !hashMatches(string(hashID), legacy.full) {
+		return "", "", false
+	}
+	return legacy.current, legacy.fingerprint, true
+}
+
+// currentHashID returns the current hash ID for the given hash ID, which may
+// have been made with an old key or another length.  Unknown hash IDs are
+// returned unchanged.
+func currentHashID(hashID hashID) hashID {
+	if current, _, ok := resolveLegacyHashID(hashID); ok {
+		return current
+	}
+	return hashID
+}
+
+// handleOldKey is called when the hash ID or the token of the request was made
+// with an old key.  The key’s fingerprint is recorded in the audit log.  If
+// redirectOldLinks is set, GET and HEAD requests are redirected to the same
+// URL with the current hash ID and token, with the same access mode and
+// expiration.  Other requests are served as they are, because browsers would
+// turn them into GET requests when following the redirect.
+func handleOldKey(controller *web.Controller, fingerprint string, hashID hashID, messageID messageID,
+	accessMode int, token string) {
+	controller.Ctx.Input.SetData("oldKey", fingerprint)
+	if method := controller.Ctx.Input.Method(); !redirectOldLinks ||
+		method != http.MethodGet && method != http.MethodHead {
+		return
+	}
+	oldHashID := controller.Ctx.Input.Param(":hash")
+	segments := strings.Split(controller.Ctx.Request.URL.Path, "/")
+	for i, segment := range segments {
+		if segment == oldHashID {
+			segments[i] = string(hashID)
+			break
+		}
+	}
+	query := controller.Ctx.Request.URL.Query()
+	if accessMode != accessSingle {
+		name := accessModeName(accessMode)
+		expires, _ := tokenExpiry(token)
+		query.Set(tokenParameter(name), makeToken(messageID, name, expires))
+	}
+	target := basePath(controller.Ctx) + strings.Join(segments, "/")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	record := newAuditRecord(controller, auditRedirected)
+	record.MessageID = messageID
+	writeAuditRecord(record)
+	controller.Redirect(target, http.StatusMovedPermanently)
+	controller.StopRun()
+}
+
+// oldKeyUsage is the usage of one old key in the audit log.
+type oldKeyUsage struct {
+	accesses int
+	links    map[string]bool
+	last     time.Time
+}
+
+// reportOldKeyLinks implements the command “mail2web old-key-links”.  It
+// prints how often links with old keys were used according to the audit log.
+func reportOldKeyLinks(args []string) {
+	config, err := loadKeyConfig(args)
+	if err != nil {
+		logger.Fatalln("Invalid configuration:", err)
+	}
+	auditLogPath = config.AuditLogPath
+	readSecretKeys(config)
+	check(writeOldKeyLinks(os.Stdout))
+}
+
+// writeOldKeyLinks writes the report of reportOldKeyLinks to the given writer.
+func writeOldKeyLinks(writer io.Writer) error {
+	configured := make(map[string]bool)
+	for _, key := range oldSecretKeys {
+		configured[keyFingerprint(key)] = true
+	}
+	usages := make(map[string]*oldKeyUsage)
+	_, err := readAuditLog(func(record auditRecord) bool {
+		if record.OldKey == "" {
+			return false
+		}
+		usage := usages[record.OldKey]
+		if usage == nil {
+			usage = &oldKeyUsage{links: make(map[string]bool)}
+			usages[record.OldKey] = usage
+		}
+		usage.accesses++
+		usage.links[string(record.HashID)+" "+record.AccessMode] = true
+		if record.Time.After(usage.last) {
+			usage.last = record.Time
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if len(usages) == 0 {
+		_, err := fmt.Fprintln(writer, "No links with old keys found in the audit log.")
+		return err
+	}
+	fingerprints := make([]string, 0, len(usages))
+	for fingerprint := range usages {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	for _, fingerprint := range fingerprints {
+		usage := usages[fingerprint]
+		status := "no longer accepted"
+		if configured[fingerprint] {
+			status = "still accepted"
+		}
+		if _, err := fmt.Fprintf(writer, "key %v (%v): %v distinct links, %v accesses, last on %v\n", fingerprint,
+			status, len(usage.links), usage.accesses, usage.last.Format("2006-01-02 15:04:05")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
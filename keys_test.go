@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withOldKey adds the given old secret key for the duration of the test.  The
+// hash IDs of all test mails under it are registered.
+func withOldKey(t *testing.T, key []byte) {
+	reregister := func() {
+		for _, mail := range testMails {
+			registerLegacyHashIDs(messageID(mail.messageID), testHashID(messageID(mail.messageID)))
+		}
+	}
+	oldSecretKeys = [][]byte{key}
+	reregister()
+	t.Cleanup(func() {
+		for _, mail := range testMails {
+			unregisterLegacyHashIDs(messageID(mail.messageID))
+		}
+		oldSecretKeys = nil
+		redirectOldLinks = false
+		reregister()
+	})
+}
+
+func TestOldKey(t *testing.T) {
+	oldKey := []byte("old test secret key")
+	withOldKey(t, oldKey)
+	const messageID = "reply1@example.com"
+	current := testHashID(messageID)
+	old := hashMessageIDWithKey(oldKey, messageID, "")
+	expires := time.Now().AddDate(0, 1, 0)
+	oldToken := makeTokenWithKey(oldKey, messageID, "full", expires)
+
+	t.Run("hash ID", func(t *testing.T) {
+		if response := serve(httptest.NewRequest(http.MethodGet, "/"+string(old), nil)); response.Code != http.StatusOK {
+			t.Errorf("status %v for old-key hash ID", response.Code)
+		}
+	})
+	t.Run("token", func(t *testing.T) {
+		path := "/" + string(current) + "?tokenFull=" + oldToken
+		if response := serve(httptest.NewRequest(http.MethodGet, path, nil)); response.Code != http.StatusOK {
+			t.Errorf("status %v for old-key token", response.Code)
+		}
+		path = "/" + string(current) + "?tokenFull=" +
+			makeTokenWithKey([]byte("unknown key"), messageID, "full", expires)
+		if response := serve(httptest.NewRequest(http.MethodGet, path, nil)); response.Code != http.StatusForbidden {
+			t.Errorf("status %v for token with unknown key", response.Code)
+		}
+	})
+	t.Run("redirect", func(t *testing.T) {
+		redirectOldLinks = true
+		t.Cleanup(func() { redirectOldLinks = false })
+		response := serve(httptest.NewRequest(http.MethodGet, "/"+string(old)+"?tokenFull="+oldToken, nil))
+		if response.Code != http.StatusMovedPermanently {
+			t.Fatalf("status %v instead of redirect", response.Code)
+		}
+		location, err := url.Parse(response.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Path != "/"+string(current) {
+			t.Errorf("redirected to path %v", location.Path)
+		}
+		if token := location.Query().Get("tokenFull"); token != makeToken(messageID, "full", expires) {
+			t.Errorf("redirected with token %v", token)
+		}
+	})
+	t.Run("no redirect for POST", func(t *testing.T) {
+		redirectOldLinks = true
+		t.Cleanup(func() { redirectOldLinks = false })
+		root := testHashID("root@example.com")
+		request := httptest.NewRequest(http.MethodPost, "/restricted/"+string(old)+"/subscribe?tokenFull="+oldToken,
+			strings.NewReader("csrf="+csrfToken("alice")))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("alice", "")
+		if response := serve(request); response.Code != http.StatusOK {
+			t.Fatalf("status %v for POST with old key: %s", response.Code, response.Body.Bytes())
+		}
+		if !isSubscribed("alice", root) {
+			t.Error("POST with old key did not subscribe")
+		}
+		unsubscribe("alice", root)
+	})
+	t.Run("report", func(t *testing.T) {
+		fingerprint := keyFingerprint(oldKey)
+		var report bytes.Buffer
+		if err := writeOldKeyLinks(&report); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(report.String(), "key "+fingerprint+" (still accepted): ") {
+			t.Errorf("old key missing in report: %v", report.String())
+		}
+		oldSecretKeys = nil
+		report.Reset()
+		err := writeOldKeyLinks(&report)
+		oldSecretKeys = [][]byte{oldKey}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(report.String(), "key "+fingerprint+" (no longer accepted): ") {
+			t.Errorf("removed key not reported as such: %v", report.String())
+		}
+	})
+}
@@ -7,6 +7,8 @@ parser = argparse.ArgumentParser(description="Calculating links to mails.")
 parser.add_argument("path", help="absolute path to the mail file")
 parser.add_argument("--access", choices=("direct", "older", "full"),
                     help="Mode of access.  Defaults to all thread mails which are older.")
+parser.add_argument("--length", type=int, default=int(os.environ.get("M2W_HASH_LENGTH", 10)),
+                    help="Length of hash IDs and tokens.  Defaults to M2W_HASH_LENGTH or 10.")
 args = parser.parse_args()
 
 
@@ -20,10 +22,10 @@ def hash_id(message_id, salt=""):
     if salt:
         hash_.update((salt + ">").encode())
     hash_.update(message_id.encode())
-    return base64.urlsafe_b64encode(hash_.digest())[:10].decode()
+    return base64.urlsafe_b64encode(hash_.digest())[:args.length].decode()
 
 
-message_id = email.parser.Parser().parse(open(sys.argv[1], errors="ignore"))["Message-ID"].strip().strip("<>")
+message_id = email.parser.Parser().parse(open(args.path, errors="ignore"))["Message-ID"].strip().strip("<>")
 if not args.access:
     url = url_root + hash_id(message_id)
 else:
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io/fs"
 	"log"
+	"mime"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -28,6 +32,7 @@ type (
 var (
 	logger           *log.Logger
 	includedDirs     []string
+	mailWatcher      *fsnotify.Watcher
 	onlyNumbersRegex = regexp.MustCompile("^\\d+$")
 	referenceRegex   = regexp.MustCompile("<([^>]+)")
 	emailRegex       = regexp.MustCompile("[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}" +
@@ -36,12 +41,15 @@ var (
 	hashIDs                                                         map[messageID]hashID
 	backReferences, children                                        map[hashID]map[hashID]bool
 	mailPaths                                                       map[hashID]string
+	mailInfos                                                       map[hashID]mailInfo
 	timestamps                                                      map[hashID]time.Time
 	mailsByAddress                                                  map[string]map[hashID]mailInfo
 	hashIDsLock, mailsByAddressLock                                 sync.RWMutex
 	backReferencesLock, childrenLock, mailPathsLock, timestampsLock sync.RWMutex
-	mailDir, rootURL                                                string
+	mailInfosLock                                                   sync.RWMutex
+	mailDir, rootURL, statePath                                     string
 	updates                                                         chan update
+	myMailsWindow                                                   time.Duration
 )
 
 const thirtyDays = time.Hour * 24 * 30
@@ -70,47 +78,71 @@ func parseBackreferences(field string) (result map[hashID]bool) {
 	return
 }
 
-// mailInfo is used in the HTML views and thus needs public fields.
+// mailInfo is used in the HTML views and thus needs public fields.  It
+// contains the metadata of a mail gathered while indexing, so that the mail
+// file need not be read in order to display it in e.g. a thread.
 type mailInfo struct {
-	HashID        hashID
-	MessageID     messageID
-	From, Subject string
-	Timestamp     time.Time
-	references    map[hashID]bool
+	HashID         hashID
+	MessageID      messageID
+	From, Subject  string
+	Folder         string
+	Timestamp      time.Time
+	HasAttachments bool
+	references     map[hashID]bool
+	addresses      map[string]bool
+	roles          map[string][]string
 }
 
-// FullThreadLink returns the absolute link to the mail in full-thread mode.
-// It is exported because it is needed in the views (templates).
-func (mailInfo mailInfo) FullThreadLink() template.URL {
+// FullThreadLink returns the link to the mail in full-thread mode, below the
+// given root, which may be a path prefix or an absolute URL.  It is exported
+// because it is needed in the views (templates).
+func (mailInfo mailInfo) FullThreadLink(root string) template.URL {
 	return template.URL(fmt.Sprintf(
-		"%v/%v?tokenFull=%v", rootURL, mailInfo.HashID, hashMessageID(mailInfo.MessageID, "full")))
+		"%v/%v?tokenFull=%v", root, mailInfo.HashID, hashMessageID(mailInfo.MessageID, "full")))
 }
 
 // This struct is passed through the channel “updates” to a central goroutine
 // that processes the updates.  It represents one email.  “references” contains
 // the hash IDs in the “References” header field.  “timestamp” contains the
 // date of the email.  If “delete” is true, only “hashID” is used and all other
-// fields may be left empty.
+// fields may be left empty.  “initial” is true for updates sent during the
+// initial population of the global maps, as opposed to live changes.
 type update struct {
-	delete                        bool
+	delete, initial               bool
 	rawFrom, rawTo, rawCc, rawBcc string
+	// processed is only set for a sentinel update, which carries no mail.
+	// processUpdates closes it, see waitForUpdates.
+	processed chan struct{}
 	mailInfo
 }
 
 // getAddresses returns a set with all mail adresses found in the "update"
 // object in its From, To, Cc, and Bcc fields.
 func (update update) getAddresses() (addresses map[string]bool) {
-	matches := emailRegex.FindAllStringSubmatch(update.rawFrom, -1)
-	matches = append(matches, emailRegex.FindAllStringSubmatch(update.rawTo, -1)...)
-	matches = append(matches, emailRegex.FindAllStringSubmatch(update.rawCc, -1)...)
-	matches = append(matches, emailRegex.FindAllStringSubmatch(update.rawBcc, -1)...)
 	addresses = make(map[string]bool)
-	for _, match := range matches {
-		addresses[strings.ToLower(match[0])] = true
+	for address := range update.getAddressRoles() {
+		addresses[address] = true
 	}
 	return addresses
 }
 
+// getAddressRoles returns all mail adresses found in the "update" object,
+// mapped to the header fields they occur in, i.e. “From”, “To”, “Cc”, or
+// “Bcc”.
+func (update update) getAddressRoles() (roles map[string][]string) {
+	roles = make(map[string][]string)
+	for _, field := range []struct{ name, value string }{
+		{"From", update.rawFrom}, {"To", update.rawTo}, {"Cc", update.rawCc}, {"Bcc", update.rawBcc}} {
+		for _, match := range emailRegex.FindAllStringSubmatch(field.value, -1) {
+			address := strings.ToLower(match[0])
+			if len(roles[address]) == 0 || roles[address][len(roles[address])-1] != field.name {
+				roles[address] = append(roles[address], field.name)
+			}
+		}
+	}
+	return roles
+}
+
 // isEligibleMailPath returns whether the given path refers to a file that
 // mail2web should assume to be an RFC 5322 mail file.  It is simply a filename
 // that consists only of numbers.
@@ -118,25 +150,45 @@ func isEligibleMailPath(path string) bool {
 	return onlyNumbersRegex.MatchString(filepath.Base(path))
 }
 
+// hasAttachments returns whether the mail with the given header contains
+// attachments.  Only the top-level MIME header fields are looked at, so that
+// the body need not be read during indexing: the mail itself is an attachment
+// if it has a file name or the content disposition “attachment”, and
+// “multipart/mixed” mails are assumed to carry attachments.  Mails with only
+// text and HTML alternatives, or with inline images, are “multipart/alternative”
+// or “multipart/related”.
+func hasAttachments(header textproto.MIMEHeader) bool {
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if disposition == "attachment" || dispositionParams["filename"] != "" {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return params["name"] != "" || mediaType == "multipart/mixed"
+}
+
 // processMail reads the RFC 5322 mail file at the given path and returns a
 // corresponding “update” object, ready to be sent to the “updates” channel.
-// If anything goes wrong, an empty “update” is returned.
-func processMail(path string) (update update) {
+// If the path is not eligible, an empty “update” is returned.  If the file
+// cannot be read or parsed, an error is returned.
+func processMail(path string) (update update, err error) {
 	if !isEligibleMailPath(path) {
 		return
 	}
 	file, err := os.Open(path)
-	check(err)
+	if err != nil {
+		return update, err
+	}
 	defer must.Close(file)
 	message, err := mail.ReadMessage(file)
 	if err != nil {
-		logger.Println(err)
-		return
+		return update, err
 	}
 	match := referenceRegex.FindStringSubmatch(message.Header.Get("Message-ID"))
 	if len(match) < 2 {
-		logger.Println(path, "has invalid Message-ID")
-		return
+		return update, errInvalidMessageID
 	}
 	update.MessageID = messageID(match[1])
 	update.HashID = messageIDToHashID(update.MessageID)
@@ -159,14 +211,56 @@ func processMail(path string) (update update) {
 	update.rawBcc = message.Header.Get("Bcc")
 	update.From = decodeRFC2047(update.rawFrom)
 	update.Subject = decodeRFC2047(message.Header.Get("Subject"))
-	return
+	update.HasAttachments = hasAttachments(textproto.MIMEHeader(message.Header))
+	update.Folder, err = filepath.Rel(mailDir, filepath.Dir(path))
+	if err != nil {
+		return update, err
+	}
+	update.roles = update.getAddressRoles()
+	update.addresses = update.getAddresses()
+	return update, nil
+}
+
+// indexMail processes the mail file at the given path and adds it to the
+// global maps.  Files that cannot be processed are put into quarantine.  It
+// returns the update, which is empty if the file was not indexed.  The update
+// is sent to the “updates” channel for every indexed mail, including ones
+// without references, so that new threads trigger thread events, too;
+// “initial” is passed through to processUpdates.
+func indexMail(path string, initial bool) update {
+	update, err := processMail(path)
+	if err != nil {
+		quarantine(path, err)
+		return update
+	}
+	releaseFromQuarantine(path)
+	if update.HashID == "" {
+		return update
+	}
+	registerLegacyHashIDs(update.MessageID, update.HashID)
+	mailPathsLock.Lock()
+	mailPaths[update.HashID] = path
+	mailPathsLock.Unlock()
+	mailInfosLock.Lock()
+	mailInfos[update.HashID] = update.mailInfo
+	mailInfosLock.Unlock()
+	mailsByAddressLock.Lock()
+	for address := range update.addresses {
+		if mailsByAddress[address] == nil {
+			mailsByAddress[address] = make(map[hashID]mailInfo)
+		}
+		mailsByAddress[address][update.HashID] = update.mailInfo
+	}
+	mailsByAddressLock.Unlock()
+	update.initial = initial
+	updates <- update
+	return update
 }
 
 // setupLogging sets up logging into a file.  The file is called
-// “mail2web.log”, and the directory is taken from the environment variable
-// M2W_LOG_PATH.  If this is not set, Go’s default logger ist used.
-func setupLogging() *log.Logger {
-	logPath := os.Getenv("M2W_LOG_PATH")
+// “mail2web.log”, and resides in the given directory.  If this is empty, Go’s
+// default logger ist used.
+func setupLogging(logPath string) *log.Logger {
 	if logPath == "" {
 		return log.Default()
 	}
@@ -178,35 +272,54 @@ func setupLogging() *log.Logger {
 	return log.New(logfile, "", log.Lshortfile|log.LstdFlags)
 }
 
+// setUpIndex takes the locations of the mails and of the state from the
+// configuration.
+func setUpIndex(config *config) {
+	mailDir = config.MailDir
+	rootURL = config.RootURL
+	publicOrigin = strings.TrimSuffix(config.PublicOrigin, "/")
+	includedDirs = config.MailFolders
+	statePath = config.StatePath
+	auditLogPath = config.AuditLogPath
+	myMailsWindow = time.Duration(config.MyMailsDays) * 24 * time.Hour
+}
+
 func init() {
-	logger = setupLogging()
-	mailDir = os.Getenv("MAILDIR")
-	if mailDir == "" {
-		mailDir = "/var/lib/mails"
-	}
-	rootURL := os.Getenv("ROOT_URL")
-	if rootURL != "" && !strings.HasPrefix(rootURL, "/") {
-		logger.Panic("ROOT_URL must be empty or start with a slash")
-	}
-	includedDirs = strings.Split(os.Getenv("MAIL_FOLDERS"), ",")
 	hashIDs = make(map[messageID]hashID)
 	backReferences = make(map[hashID]map[hashID]bool)
 	children = make(map[hashID]map[hashID]bool)
 	mailPaths = make(map[hashID]string)
+	mailInfos = make(map[hashID]mailInfo)
 	mailsByAddress = make(map[string]map[hashID]mailInfo)
 	timestamps = make(map[hashID]time.Time)
 	updates = make(chan update, 1000_000)
 }
 
+// waitForUpdates blocks until all updates sent to the “updates” channel so far
+// are processed.  For this, it sends a sentinel update, which processUpdates
+// acknowledges after all updates before it.
+func waitForUpdates() {
+	processed := make(chan struct{})
+	updates <- update{processed: processed}
+	<-processed
+}
+
 // processUpdates is a goroutine running for the whole run time of the program.
 // It reads from the channel “updates” and updates the global data structures
 // “backReferences”, “children”, “mailPaths”, and “timestamps” accordingly.
 // To keep those mappings consistent, sending to the “updates” channel should
 // be the only may to write to them.  Besides, the channel is faster for
-// serialisition than write locks.
+// serialisition than write locks.  Every live change is dispatched as a
+// threadEvent.
 func processUpdates() {
 	for update := range updates {
-		if update.delete {
+		if update.processed != nil {
+			close(update.processed)
+		} else if update.delete {
+			event := threadEvent{removed: true, mailInfo: update.mailInfo}
+			if threadEventsNeeded() {
+				event.thread = collectThread(update.HashID)
+			}
 			backReferencesLock.RLock()
 			formerBackReferences, ok := backReferences[update.HashID]
 			backReferencesLock.RUnlock()
@@ -223,8 +336,10 @@ func processUpdates() {
 			timestampsLock.Lock()
 			delete(timestamps, update.HashID)
 			timestampsLock.Unlock()
+			dispatchThreadEvent(event)
 		} else {
 			backReferencesLock.Lock()
+			_, known := backReferences[update.HashID]
 			backReferences[update.HashID] = update.references
 			backReferencesLock.Unlock()
 			for reference := range update.references {
@@ -241,48 +356,47 @@ func processUpdates() {
 			timestampsLock.Lock()
 			timestamps[update.HashID] = update.Timestamp
 			timestampsLock.Unlock()
+			if !update.initial && !known {
+				dispatchThreadEvent(threadEvent{mailInfo: update.mailInfo})
+			}
 		}
 	}
 }
 
-// populateGlobalMaps walks once through all mail files and sends them to the
-// “updates” channel.  This routine runs once, at the very beginning of the
-// program, to take care of the initial population of the global maps.
-func populateGlobalMaps() {
+// populateGlobalMaps walks once through all mail files in the given folders and
+// sends them to the “updates” channel.  This routine runs at the very
+// beginning of the program, to take care of the initial population of the
+// global maps, and for folders added at runtime.  The files are counted in
+// “progress”.  If a folder cannot be walked, e.g. because it does not exist,
+// the other folders are indexed nevertheless, and the first such error is
+// returned.
+func populateGlobalMaps(folders []string, progress *indexingProgress) (walkErr error) {
 	paths := make(chan string)
 	var workersWaitGroup sync.WaitGroup
 	for i := 0; i < runtime.NumCPU()*2; i++ {
 		workersWaitGroup.Add(1)
 		go func() {
 			for path := range paths {
-				if update := processMail(path); update.HashID != "" {
-					mailPathsLock.Lock()
-					mailPaths[update.HashID] = path
-					mailPathsLock.Unlock()
-					if time.Since(update.Timestamp) <= thirtyDays {
-						mailsByAddressLock.Lock()
-						for address := range update.getAddresses() {
-							if mailsByAddress[address] == nil {
-								mailsByAddress[address] = make(map[hashID]mailInfo)
-							}
-							mailsByAddress[address][update.HashID] = update.mailInfo
-						}
-						mailsByAddressLock.Unlock()
-					}
-					if len(update.references) > 0 {
-						updates <- update
-					}
-				}
+				indexMail(path, true)
+				progress.filesIndexed.Add(1)
 			}
 			workersWaitGroup.Done()
 		}()
 	}
-	for _, dir := range includedDirs {
+	for _, dir := range folders {
 		currentDir := filepath.Join(mailDir, dir)
 		err := filepath.WalkDir(currentDir,
 			func(path string, d fs.DirEntry, err error) error {
 				if err != nil {
-					return err
+					if path == currentDir {
+						return err
+					}
+					if isEligibleMailPath(path) {
+						quarantine(path, err)
+					} else {
+						logger.Println(err)
+					}
+					return nil
 				}
 				if d.IsDir() {
 					if path != currentDir {
@@ -290,13 +404,41 @@ func populateGlobalMaps() {
 					}
 					return nil
 				}
+				progress.filesFound.Add(1)
 				paths <- path
 				return nil
 			})
-		check(err)
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
 	}
+	progress.walkCompleted.Store(true)
 	close(paths)
 	workersWaitGroup.Wait()
+	return walkErr
+}
+
+// unindexMail removes the mail with the given hash ID from the global maps and
+// sends the deletion to the “updates” channel.
+func unindexMail(hashID hashID) {
+	mailPathsLock.Lock()
+	delete(mailPaths, hashID)
+	mailPathsLock.Unlock()
+	mailInfosLock.Lock()
+	mailInfo := mailInfos[hashID]
+	delete(mailInfos, hashID)
+	mailInfosLock.Unlock()
+	mailInfo.HashID = hashID
+	unregisterLegacyHashIDs(mailInfo.MessageID)
+	updates <- update{
+		delete:   true,
+		mailInfo: mailInfo,
+	}
+	mailsByAddressLock.Lock()
+	for _, mails := range mailsByAddress {
+		delete(mails, hashID)
+	}
+	mailsByAddressLock.Unlock()
 }
 
 // setUpWatcher starts a goroutine that watches for changes in the mail folders
@@ -304,37 +446,26 @@ func populateGlobalMaps() {
 func setUpWatcher() {
 	watcher, err := fsnotify.NewWatcher()
 	check(err)
+	mailWatcher = watcher
 
 	go func() {
 		for {
 			select {
 			case event := <-watcher.Events:
+				countWatcherEvent(event)
 				if event.Op&fsnotify.Create == fsnotify.Create ||
 					event.Op&fsnotify.Write == fsnotify.Write {
-					if update := processMail(event.Name); update.HashID != "" {
+					if update := indexMail(event.Name, false); update.HashID != "" {
 						if event.Op&fsnotify.Create == fsnotify.Create {
 							logger.Println("WATCHER: created file:", event.Name)
 						} else {
 							logger.Println("WATCHER: wrote (updated) file:", event.Name)
 						}
-						mailPathsLock.Lock()
-						mailPaths[update.HashID] = event.Name
-						mailPathsLock.Unlock()
-						mailsByAddressLock.Lock()
-						for address := range update.getAddresses() {
-							if mailsByAddress[address] == nil {
-								mailsByAddress[address] = make(map[hashID]mailInfo)
-							}
-							mailsByAddress[address][update.HashID] = update.mailInfo
-						}
-						mailsByAddressLock.Unlock()
-						if len(update.references) > 0 {
-							updates <- update
-						}
 					}
 				} else if event.Op&fsnotify.Remove == fsnotify.Remove ||
 					event.Op&fsnotify.Rename == fsnotify.Rename {
 					if isEligibleMailPath(event.Name) {
+						releaseFromQuarantine(event.Name)
 						var hashID hashID
 						mailPathsLock.RLock()
 						for currentMessageID, path := range mailPaths {
@@ -346,23 +477,12 @@ func setUpWatcher() {
 						mailPathsLock.RUnlock()
 						if hashID != "" {
 							logger.Println("WATCHER: deleted file:", event.Name)
-							mailPathsLock.Lock()
-							delete(mailPaths, hashID)
-							mailPathsLock.Unlock()
-							updates <- update{
-								delete:   true,
-								mailInfo: mailInfo{HashID: hashID},
-							}
-						}
-						mailsByAddressLock.Lock()
-						for _, mails := range mailsByAddress {
-							delete(mails, hashID)
+							unindexMail(hashID)
 						}
-						mailsByAddressLock.Unlock()
 					}
 				}
 			case err := <-watcher.Errors:
-				check(err)
+				logger.Println("WATCHER:", err)
 			}
 		}
 	}()
@@ -375,9 +495,37 @@ func setUpWatcher() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "old-key-links" {
+		logger = log.Default()
+		reportOldKeyLinks(os.Args[2:])
+		return
+	}
+	config, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+	logger = setupLogging(config.LogPath)
+	setUpIndex(config)
+	setUpPermissions(config)
+	check(setUpMail(config))
+	setUpTrustedProxies(config)
+	setUpRateLimiting(config)
+	loadLinkRequests(config)
+	loadSubscriptions(config)
+	setUpWebhookQueue(config)
+	currentConfig = config
 	go processUpdates()
+	go runThreadEventQueue()
+	go runWebhookDeliveries()
+	go runNotifications()
+	go runQuarantineRetries()
+	setUpAuthentication(config)
 	setUpWatcher()
-	populateGlobalMaps()
+	indexingStart = time.Now()
+	go indexMails()
+	go watchConfig()
 
 	web.Run()
 }
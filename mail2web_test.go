@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestPopulateGlobalMapsMissingFolder(t *testing.T) {
+	found := initialIndexing.filesFound.Load()
+	var progress indexingProgress
+	if err := populateGlobalMaps([]string{"missing", "inbox"}, &progress); err == nil {
+		t.Error("no error for missing folder")
+	}
+	if indexed := progress.filesIndexed.Load(); indexed != int64(len(testMails)) {
+		t.Errorf("indexed %v files of the existing folder, expected %v", indexed, len(testMails))
+	}
+	if !progress.walkCompleted.Load() {
+		t.Error("walk not completed")
+	}
+	if initialIndexing.filesFound.Load() != found {
+		t.Error("files were counted for the initial indexing")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/beego/beego/v2/server/web"
+)
+
+// testMail is a mail of the test archive.  The mails form one thread:
+//
+//	root
+//	├── reply1
+//	│   └── reply2
+//	└── reply3
+type testMail struct {
+	file, messageID, from, date, references, subject string
+}
+
+var testMails = []testMail{
+	{"1", "root@example.com", "Alice <alice@example.com>", "Mon, 01 Jan 2024 10:00:00 +0000", "", "Plan"},
+	{"2", "reply1@example.com", "Bob <bob@example.com>", "Tue, 02 Jan 2024 10:00:00 +0000",
+		"<root@example.com>", "Re: Plan"},
+	{"3", "reply2@example.com", "Alice <alice@example.com>", "Wed, 03 Jan 2024 10:00:00 +0000",
+		"<root@example.com> <reply1@example.com>", "Re: Plan"},
+	{"4", "reply3@example.com", "Carol <carol@example.com>", "Thu, 04 Jan 2024 10:00:00 +0000",
+		"<root@example.com>", "Re: Plan"},
+}
+
+// writeTestMail writes the given mail as an RFC 5322 file into the folder.
+func writeTestMail(folder string, mail testMail) {
+	content := fmt.Sprintf("Message-ID: <%v>\nFrom: %v\nTo: Bob <bob@example.com>\nDate: %v\nSubject: %v\n",
+		mail.messageID, mail.from, mail.date, mail.subject)
+	if mail.references != "" {
+		content += "References: " + mail.references + "\n"
+	}
+	content += "\nHello,\n\nthis is " + mail.messageID + ".\n"
+	check(os.WriteFile(filepath.Join(folder, mail.file), []byte(content), 0o600))
+}
+
+// TestMain sets up an archive with the test mails, indexes it, and configures
+// mail2web like main does, but without reading settings or serving on a port.
+func TestMain(m *testing.M) {
+	logger = log.New(io.Discard, "", 0)
+	web.BConfig.RunMode = web.PROD
+	dir, err := os.MkdirTemp("", "mail2web-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mailDir = filepath.Join(dir, "mails")
+	statePath = filepath.Join(dir, "state")
+	auditLogPath = filepath.Join(statePath, "audit.jsonl")
+	includedDirs = []string{"inbox"}
+	check(os.MkdirAll(filepath.Join(mailDir, "inbox"), 0o700))
+	check(os.MkdirAll(statePath, 0o700))
+	for _, mail := range testMails {
+		writeTestMail(filepath.Join(mailDir, "inbox"), mail)
+	}
+	secretKey = []byte("test secret key")
+	permissions.Admin = "admin"
+	permissions.Addresses = map[string][]string{
+		"admin": {"admin@example.com"},
+		"alice": {"alice@example.com"},
+	}
+	loadSubscriptions(&config{StatePath: statePath})
+	loadLinkRequests(&config{StatePath: statePath})
+	check(setUpMail(&config{RequestMailTemplate: "requestMail.tpl"}))
+	setUpRateLimiting(&config{RateLimitPerIP: 1000, RateLimitGlobal: 1000})
+	setUpAuthentication(&config{AuthMode: authBasicProxy})
+	check(web.AddViewPath("views"))
+	go processUpdates()
+	go runThreadEventQueue()
+	check(populateGlobalMaps(includedDirs, &initialIndexing))
+	waitForUpdates()
+	ready.Store(true)
+	code := m.Run()
+	check(os.RemoveAll(dir))
+	os.Exit(code)
+}
+
+// serve answers the given request with mail2web’s router.
+func serve(request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	web.BeeApp.Handlers.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// testHashID returns the hash ID of the test mail with the given message ID.
+func testHashID(messageID messageID) hashID {
+	return hashMessageID(messageID, "")
+}
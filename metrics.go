@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/beego/beego/v2/server/web/context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	watcherEventsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_watcher_events_total",
+		Help: "Number of file system events in the mail folders, per operation.",
+	}, []string{"op"})
+	cacheLookupsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_cache_lookups_total",
+		Help: "Number of lookups in the caches (“envelopes” or “thread_roots”), per result (“hit” or “miss”).",
+	}, []string{"cache", "result"})
+	deniedRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_denied_requests_total",
+		Help: "Number of denied accesses, per HTTP status code and reason.",
+	}, []string{"status", "reason"})
+	smtpSendsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_smtp_sends_total",
+		Help: "Number of mails sent via SMTP, per result (“success” or “failure”).",
+	}, []string{"result"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mail2web_request_duration_seconds",
+		Help:    "Latency of HTTP requests, per route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// indexCollector exports the sizes of the in-memory index.  They are computed
+// at scrape time.
+type indexCollector struct {
+	mails, threads, addresses, queuedUpdates, indexingDuration *prometheus.Desc
+}
+
+func newIndexCollector() *indexCollector {
+	return &indexCollector{
+		mails: prometheus.NewDesc("mail2web_indexed_mails",
+			"Number of indexed mails, per folder.", []string{"folder"}, nil),
+		threads: prometheus.NewDesc("mail2web_threads",
+			"Number of threads of the indexed mails.", nil, nil),
+		addresses: prometheus.NewDesc("mail2web_addresses",
+			"Number of mail addresses in the indexed mails.", nil, nil),
+		queuedUpdates: prometheus.NewDesc("mail2web_queued_updates",
+			"Number of updates waiting to be processed.", nil, nil),
+		indexingDuration: prometheus.NewDesc("mail2web_indexing_duration_seconds",
+			"Duration of the initial indexing, or time since its start while it lasts.", nil, nil),
+	}
+}
+
+func (collector *indexCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.mails
+	ch <- collector.threads
+	ch <- collector.addresses
+	ch <- collector.queuedUpdates
+	ch <- collector.indexingDuration
+}
+
+func (collector *indexCollector) Collect(ch chan<- prometheus.Metric) {
+	mailsPerFolder := make(map[string]int)
+	mailInfosLock.RLock()
+	for _, info := range mailInfos {
+		mailsPerFolder[info.Folder]++
+	}
+	mailInfosLock.RUnlock()
+	for folder, count := range mailsPerFolder {
+		ch <- prometheus.MustNewConstMetric(collector.mails, prometheus.GaugeValue, float64(count), folder)
+	}
+	ch <- prometheus.MustNewConstMetric(collector.threads, prometheus.GaugeValue, float64(countThreads()))
+	mailsByAddressLock.RLock()
+	addresses := len(mailsByAddress)
+	mailsByAddressLock.RUnlock()
+	ch <- prometheus.MustNewConstMetric(collector.addresses, prometheus.GaugeValue, float64(addresses))
+	ch <- prometheus.MustNewConstMetric(collector.queuedUpdates, prometheus.GaugeValue, float64(len(updates)))
+	ch <- prometheus.MustNewConstMetric(collector.indexingDuration, prometheus.GaugeValue,
+		getReadiness().IndexingDuration)
+}
+
+// countThreads returns the number of threads among the indexed mails.  Mails
+// belong to the same thread if they are connected by references, possibly via
+// mails which are not available.
+func countThreads() int {
+	parents := make(map[hashID]hashID)
+	var find func(node hashID) hashID
+	find = func(node hashID) hashID {
+		parent, ok := parents[node]
+		if !ok || parent == node {
+			return node
+		}
+		root := find(parent)
+		parents[node] = root
+		return root
+	}
+	backReferencesLock.RLock()
+	for node, references := range backReferences {
+		for reference := range references {
+			if root, referenceRoot := find(node), find(reference); root != referenceRoot {
+				parents[root] = referenceRoot
+			}
+		}
+	}
+	backReferencesLock.RUnlock()
+	roots := make(map[hashID]bool)
+	mailInfosLock.RLock()
+	for node := range mailInfos {
+		roots[find(node)] = true
+	}
+	mailInfosLock.RUnlock()
+	return len(roots)
+}
+
+// countWatcherEvent counts the event in the watcher metrics.  An event may
+// combine several operations; each one is counted.
+func countWatcherEvent(event fsnotify.Event) {
+	for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod} {
+		if event.Op&op == op {
+			watcherEventsCounter.WithLabelValues(op.String()).Inc()
+		}
+	}
+}
+
+// countCacheLookup counts a lookup in the cache with the given name.
+func countCacheLookup(cache string, hit bool) {
+	if hit {
+		cacheLookupsCounter.WithLabelValues(cache, "hit").Inc()
+	} else {
+		cacheLookupsCounter.WithLabelValues(cache, "miss").Inc()
+	}
+}
+
+// countSMTPResult counts a mail sent via SMTP, with “err” being the result of
+// sending.
+func countSMTPResult(err error) {
+	if err != nil {
+		smtpSendsCounter.WithLabelValues("failure").Inc()
+	} else {
+		smtpSendsCounter.WithLabelValues("success").Inc()
+	}
+}
+
+// standardMethods are the HTTP methods which are used as “method” label as
+// they are.
+var standardMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true,
+	http.MethodTrace: true,
+}
+
+// methodLabel returns the given HTTP method as metrics label.  Clients can
+// send arbitrary methods, so all non-standard ones are mapped to “other” to
+// keep the number of time series bounded.
+func methodLabel(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// measureRequests is a filter chain which records the latency of all
+// requests.  The route is the router pattern, so that it corresponds to the
+// controller.  Requests without matching route, e.g. those rejected by
+// filters, have the route “none”.
+func measureRequests(next web.FilterFunc) web.FilterFunc {
+	return func(ctx *context.Context) {
+		start := time.Now()
+		next(ctx)
+		route, _ := ctx.Input.GetData("RouterPattern").(string)
+		if route == "" {
+			route = "none"
+		}
+		requestDuration.WithLabelValues(route, methodLabel(ctx.Input.Method())).Observe(time.Since(start).Seconds())
+	}
+}
+
+func init() {
+	prometheus.MustRegister(newIndexCollector())
+	web.InsertFilterChain("*", measureRequests)
+}
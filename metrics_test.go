@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestMethodLabel(t *testing.T) {
+	for method, label := range map[string]string{
+		"GET": "GET", "POST": "POST", "OPTIONS": "OPTIONS", "get": "other", "PROPFIND": "other", "": "other",
+	} {
+		if result := methodLabel(method); result != label {
+			t.Errorf("label %q for method %q, expected %q", result, method, label)
+		}
+	}
+}
@@ -1,21 +1,39 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// shortestHashLength is the length of all hash IDs and tokens issued
+	// before the length became configurable.
+	shortestHashLength = 10
+	// fullHashLength is the length of the complete base64-encoded SHA-256
+	// hash.
+	fullHashLength = 43
+)
+
 var (
 	permissionsPath string
 	secretKey       []byte
+	// hashLength is the length of newly issued hash IDs and tokens.
+	hashLength = shortestHashLength
+	// minHashLength is the length below which hash IDs and tokens are
+	// rejected.
+	minHashLength = shortestHashLength
 )
 
+// permissionsLock protects “permissions” while readPermissions rewrites it.
+var permissionsLock sync.RWMutex
+
 var permissions struct {
 	Admin     string
 	Addresses map[string][]string
@@ -23,6 +41,10 @@ var permissions struct {
 		Members        map[string]bool
 		Threads, Mails map[hashID]bool
 	}
+	Webhooks []webhook
+	// SelfServiceLinks lets users get the links to mails immediately if
+	// their personal address occurs in the mail.
+	SelfServiceLinks bool `yaml:"self_service_links"`
 }
 
 // readPermissions reads the permissions.yaml file which resides in the
@@ -33,11 +55,15 @@ var permissions struct {
 func readPermissions() {
 	data, err := os.ReadFile(permissionsPath)
 	check(err)
+	permissionsLock.Lock()
+	defer permissionsLock.Unlock()
 	err = yaml.Unmarshal(data, &permissions)
 	if err != nil {
 		logger.Println("invalid permissions.yaml")
 		permissions.Addresses = nil
 		permissions.Groups = nil
+		permissions.Webhooks = nil
+		permissions.SelfServiceLinks = false
 	} else {
 		logger.Println("re-read permissions.yaml")
 	}
@@ -80,35 +106,64 @@ func getEmailAddress(loginName string) string {
 	}
 }
 
+// userEmailAddress is like getEmailAddress but returns an error for users
+// without email address, which is shown to them.
+func userEmailAddress(loginName string) (string, error) {
+	address := getEmailAddress(loginName)
+	if address == "" {
+		return "", newHTTPError(403, "No mail address is configured for user %v.", loginName)
+	}
+	return address, nil
+}
+
 // getEmailAddress returns all email addresses the given user can read.
 func getEmailAddresses(loginName string) []string {
 	return permissions.Addresses[loginName]
 }
 
-// hashMessageID hashes the message ID with a pepper taken from
-// SECRET_KEY_PATH.  The salt can be used to add futher entropy, effectively
-// selecting a hash namespace.
+// hashMessageID hashes the message ID with a pepper taken from the secret key
+// file.  The salt can be used to add futher entropy, effectively
+// selecting a hash namespace.  The result is truncated to hashLength.
 func hashMessageID(messageID messageID, salt string) hashID {
+	return hashMessageIDWithKey(secretKey, messageID, salt)
+}
+
+// hashMessageIDWithKey is like hashMessageID but uses the given key as the
+// pepper.  It is needed for old keys.
+func hashMessageIDWithKey(key []byte, messageID messageID, salt string) hashID {
+	return fullHashWithKey(key, messageID, salt)[:hashLength]
+}
+
+// fullHashWithKey is like hashMessageIDWithKey but returns the hash with
+// fullHashLength characters.  Hash IDs and tokens of any length are prefixes
+// of it.
+func fullHashWithKey(key []byte, messageID messageID, salt string) hashID {
 	hasher := sha256.New()
-	hasher.Write(secretKey)
+	hasher.Write(key)
 	if salt != "" {
 		// “>” is guaranteed to never occur in message IDs.
 		hasher.Write([]byte(salt + ">"))
 	}
 	hasher.Write([]byte(messageID))
-	return hashID(base64.URLEncoding.EncodeToString(hasher.Sum(nil))[:10])
+	return hashID(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)))
 }
 
-func init() {
-	permissionsPath = filepath.Join(mailDir, "permissions.yaml")
-	var err error
-	secretKeyPath := os.Getenv("SECRET_KEY_PATH")
-	if secretKeyPath == "" {
-		secretKeyPath = "/var/lib/mail2web_secrets/secret_key"
+// hashMatches returns whether the given hash ID or token is a prefix of the
+// full hash with at least minHashLength characters.  This way, hash IDs and
+// tokens issued with a different hashLength remain valid.  The comparison
+// takes constant time.
+func hashMatches(given string, full hashID) bool {
+	if len(given) < minHashLength || len(given) > len(full) {
+		return false
 	}
-	secretKey, err = os.ReadFile(secretKeyPath)
-	check(err)
-	secretKey = bytes.Trim(secretKey, "\t\n\r\f\v ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(full[:len(given)])) == 1
+}
+
+// setUpPermissions reads the secret keys and permissions.yaml, and starts
+// watching the latter.
+func setUpPermissions(config *config) {
+	permissionsPath = filepath.Join(config.MailDir, "permissions.yaml")
+	readSecretKeys(config)
 	readPermissions()
 	setUpPermissionsWatcher()
 }
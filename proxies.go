@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/beego/beego/v2/server/web/context"
+)
+
+var (
+	// trustedProxies are the networks of the reverse proxies whose
+	// “X-Forwarded-…” headers are believed.
+	trustedProxies     []*net.IPNet
+	trustedProxiesLock sync.RWMutex
+)
+
+// isTrustedProxy returns whether the given IP belongs to one of the trusted
+// proxies.
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	trustedProxiesLock.RLock()
+	defer trustedProxiesLock.RUnlock()
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP of the direct peer of the request, i.e. without
+// looking at any headers.
+func peerIP(ctx *context.Context) string {
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		return ctx.Request.RemoteAddr
+	}
+	return host
+}
+
+// fromTrustedProxy returns whether the request comes directly from one of the
+// trusted proxies.
+func fromTrustedProxy(ctx *context.Context) bool {
+	return isTrustedProxy(net.ParseIP(peerIP(ctx)))
+}
+
+// clientIP returns the IP of the client of the request.  “X-Forwarded-For” is
+// only read if the request comes from a trusted proxy.  Then, the rightmost
+// hop which is not a trusted proxy is the client, because everything left of
+// it may have been set by the client itself.
+func clientIP(ctx *context.Context) string {
+	ip := peerIP(ctx)
+	if !isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+	var hops []string
+	for _, header := range ctx.Request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(net.ParseIP(hop)) {
+			break
+		}
+	}
+	return ip
+}
+
+// setUpTrustedProxies takes the trusted proxies from the configuration.
+func setUpTrustedProxies(config *config) {
+	networks, err := parseNetworks(config.TrustedProxies)
+	check(err)
+	trustedProxiesLock.Lock()
+	defer trustedProxiesLock.Unlock()
+	trustedProxies = networks
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/beego/beego/v2/server/web/context"
+)
+
+// withTrustedProxies sets the trusted proxies for the duration of the test.
+func withTrustedProxies(t *testing.T, networks ...string) {
+	setUpTrustedProxies(&config{TrustedProxies: networks})
+	t.Cleanup(func() { setUpTrustedProxies(&config{}) })
+}
+
+func TestClientIP(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	for _, test := range []struct {
+		name, remoteAddr string
+		forwardedFor     []string
+		ip               string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"spoofed header", "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed hop", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:1234", []string{"198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"several headers", "10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = test.remoteAddr
+			for _, header := range test.forwardedFor {
+				request.Header.Add("X-Forwarded-For", header)
+			}
+			ctx := context.NewContext()
+			ctx.Reset(httptest.NewRecorder(), request)
+			if ip := clientIP(ctx); ip != test.ip {
+				t.Errorf("client IP %v, expected %v", ip, test.ip)
+			}
+		})
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	setUpRateLimiting(&config{RateLimitPerIP: 2, RateLimitGlobal: 1000, RateLimitAllow: []string{"198.51.100.0/24"}})
+	t.Cleanup(func() {
+		setUpRateLimiting(&config{RateLimitPerIP: 1000, RateLimitGlobal: 1000})
+		failuresLock.Lock()
+		failures = make(map[string]*failureRecord)
+		globalFailures = failureRecord{}
+		failuresLock.Unlock()
+	})
+	var status int
+	for i := 0; i < 4; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/AAAAAAAAAA", nil)
+		request.RemoteAddr = "192.0.2.77:1234"
+		request.Header.Set("X-Forwarded-For", "198.51.100."+string(rune('1'+i)))
+		status = serve(request).Code
+	}
+	if status != http.StatusTooManyRequests {
+		t.Errorf("status %v, expected lockout despite changing X-Forwarded-For", status)
+	}
+}
+
+func TestGlobalLockoutDoesNotGrow(t *testing.T) {
+	var record failureRecord
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if duration := record.register(now, 0, globalLockout); duration != globalLockout {
+			t.Fatalf("lockout %v is %v", i, duration)
+		}
+		now = now.Add(globalLockout)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+)
+
+// quarantineRetryInterval is the time after which mails which could not be
+// indexed are tried again.
+const quarantineRetryInterval = 5 * time.Minute
+
+// errInvalidMessageID is returned by processMail for mails without a valid
+// Message-ID.  This failure is permanent, so such mails are only tried again
+// if their files change.
+var errInvalidMessageID = errors.New("invalid Message-ID")
+
+// quarantinedMail is a mail file which could not be indexed, e.g. because it
+// is unreadable or has no valid Message-ID.  The fields are public because
+// they are used in the HTML view.  “Permanent” is true if retrying is
+// pointless as long as the file does not change.
+type quarantinedMail struct {
+	Path        string
+	Reason      string
+	Permanent   bool
+	Since       time.Time
+	LastAttempt time.Time
+	Attempts    int
+}
+
+var (
+	quarantinedMails     = make(map[string]*quarantinedMail)
+	quarantinedMailsLock sync.RWMutex
+)
+
+// quarantine records that the mail file at the given path could not be
+// indexed because of “err”.
+func quarantine(path string, err error) {
+	now := time.Now()
+	quarantinedMailsLock.Lock()
+	defer quarantinedMailsLock.Unlock()
+	mail := quarantinedMails[path]
+	if mail == nil {
+		logger.Printf("Could not index %v: %v", path, err)
+		mail = &quarantinedMail{Path: path, Since: now}
+		quarantinedMails[path] = mail
+	}
+	mail.Reason = err.Error()
+	mail.Permanent = errors.Is(err, errInvalidMessageID)
+	mail.LastAttempt = now
+	mail.Attempts++
+}
+
+// releaseFromQuarantine removes the mail file at the given path from the
+// quarantine, if it is there.  It is called after the file was indexed
+// successfully or was removed.
+func releaseFromQuarantine(path string) {
+	quarantinedMailsLock.Lock()
+	defer quarantinedMailsLock.Unlock()
+	if _, ok := quarantinedMails[path]; ok {
+		logger.Println("Released from quarantine:", path)
+		delete(quarantinedMails, path)
+	}
+}
+
+// getQuarantinedMails returns copies of all quarantined mails, sorted by path.
+func getQuarantinedMails() []quarantinedMail {
+	quarantinedMailsLock.RLock()
+	result := make([]quarantinedMail, 0, len(quarantinedMails))
+	for _, mail := range quarantinedMails {
+		result = append(result, *mail)
+	}
+	quarantinedMailsLock.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// runQuarantineRetries tries to index the quarantined mails again every
+// quarantineRetryInterval, except for those with permanent failures.  Mails
+// whose files have vanished are dropped silently.  It never returns.
+func runQuarantineRetries() {
+	for range time.Tick(quarantineRetryInterval) {
+		for _, mail := range getQuarantinedMails() {
+			if _, err := os.Stat(mail.Path); errors.Is(err, fs.ErrNotExist) {
+				releaseFromQuarantine(mail.Path)
+				continue
+			}
+			if mail.Permanent {
+				continue
+			}
+			indexMail(mail.Path, false)
+		}
+	}
+}
+
+type AdminQuarantineController struct {
+	web.Controller
+}
+
+// Controller for listing the mails which could not be indexed, together with
+// the reason.
+func (this *AdminQuarantineController) Get() {
+	checkAdmin(&this.Controller)
+	this.TplName = "adminQuarantine.tpl"
+	this.Data["mails"] = getQuarantinedMails()
+	this.Data["retryInterval"] = quarantineRetryInterval
+}
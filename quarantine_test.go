@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	folder := filepath.Join(mailDir, "inbox")
+	invalid := filepath.Join(folder, "200")
+	check(os.WriteFile(invalid, []byte("From: Erin <erin@example.com>\nSubject: No ID\n\nHello\n"), 0o600))
+	missing := filepath.Join(folder, "201")
+	t.Cleanup(func() {
+		check(os.Remove(invalid))
+		releaseFromQuarantine(invalid)
+		releaseFromQuarantine(missing)
+	})
+	indexMail(invalid, false)
+	indexMail(missing, false)
+	mails := make(map[string]quarantinedMail)
+	for _, mail := range getQuarantinedMails() {
+		mails[mail.Path] = mail
+	}
+	if mail, ok := mails[invalid]; !ok || !mail.Permanent || mail.Reason != errInvalidMessageID.Error() {
+		t.Errorf("mail without Message-ID not quarantined permanently: %+v", mail)
+	}
+	if mail, ok := mails[missing]; !ok || mail.Permanent {
+		t.Errorf("missing mail not quarantined temporarily: %+v", mail)
+	}
+	writeTestMail(folder, testMail{"200", "fixed@example.com", "Erin <erin@example.com>",
+		"Sat, 06 Jan 2024 10:00:00 +0000", "", "Fixed"})
+	indexMail(invalid, false)
+	t.Cleanup(func() { unindexMail(testHashID("fixed@example.com")) })
+	for _, mail := range getQuarantinedMails() {
+		if mail.Path == invalid {
+			t.Error("fixed mail still in quarantine")
+		}
+	}
+}
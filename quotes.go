@@ -0,0 +1,284 @@
+package main
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// attributionRegex matches lines like “On Monday, Bob wrote:” which
+	// introduce a citation.  It covers English, German, French, Spanish,
+	// Italian, Dutch, Portuguese, and Polish mail clients.
+	attributionRegex = regexp.MustCompile(`(?i)^\s*(on\s.*\swrote|am\s.*\sschrieb.*|le\s.*\sa\s+écrit|` +
+		`el\s.*\sescribió|il\s.*\sha\s+scritto|op\s.*\sschreef.*|em\s.*\sescreveu|w\s+dniu\s.*\spisze)\s*:\s*$`)
+	// outlookSeparatorRegex matches the lines Outlook and similar clients put
+	// above the mail they reply to or forward.
+	outlookSeparatorRegex = regexp.MustCompile(`(?i)^\s*(-{3,}\s*(original message|ursprüngliche nachricht|` +
+		`message d'origine|mensaje original|messaggio originale|oorspronkelijk bericht|` +
+		`forwarded message|weitergeleitete nachricht)\s*-{3,}|_{20,})\s*$`)
+	outlookFromRegex = regexp.MustCompile(`(?i)^\s*(from|von|de|da|van)\s?:\s`)
+	outlookSentRegex = regexp.MustCompile(`(?i)^\s*(sent|date|gesendet|datum|envoyé|enviado|inviato|verzonden)\s?:\s`)
+)
+
+// isQuotedLine returns whether the given line of a plain text mail is part of
+// a citation, i.e. starts with “>” (possibly after some white space).
+func isQuotedLine(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " \t"), ">")
+}
+
+// isSignatureSeparator returns whether the given line is the “-- ” line that
+// introduces a signature.  The variant without the trailing space is accepted,
+// too, because many mail clients strip it.
+func isSignatureSeparator(line string) bool {
+	return strings.TrimRight(line, " \r") == "--"
+}
+
+// isOutlookSeparator returns whether the line with the given index starts an
+// Outlook-style citation, which extends to the end of the mail.  This is
+// either an explicit separator line, or a “From:” line directly followed by a
+// “Sent:” line.
+func isOutlookSeparator(lines []string, i int) bool {
+	if outlookSeparatorRegex.MatchString(lines[i]) {
+		return true
+	}
+	return outlookFromRegex.MatchString(lines[i]) && i+1 < len(lines) && outlookSentRegex.MatchString(lines[i+1])
+}
+
+// attributionLength returns the number of lines of the attribution line
+// starting at the line with the given index, or 0 if there is none.  An
+// attribution must be followed by a quoted line (possibly after empty lines).
+// Since mail clients often wrap long attribution lines, an attribution may
+// span two lines.
+func attributionLength(lines []string, i int) int {
+	var length int
+	if attributionRegex.MatchString(lines[i]) {
+		length = 1
+	} else if i+1 < len(lines) && strings.TrimSpace(lines[i]) != "" &&
+		attributionRegex.MatchString(lines[i]+" "+lines[i+1]) {
+		length = 2
+	} else {
+		return 0
+	}
+	for j := i + length; j < len(lines); j++ {
+		if isQuotedLine(lines[j]) {
+			return length
+		}
+		if strings.TrimSpace(lines[j]) != "" {
+			break
+		}
+	}
+	return 0
+}
+
+const (
+	blockText = iota
+	blockQuote
+	blockSignature
+)
+
+// textBlock is a run of lines in a plain text mail body of the same kind,
+// i.e. blockText, blockQuote, or blockSignature.
+type textBlock struct {
+	kind  int
+	lines []string
+}
+
+// splitTextBlocks splits the given plain text mail body into runs of normal
+// text, quoted text, and signatures.  Attributions are part of the quote they
+// introduce.  Everything after an Outlook separator is considered quoted.  A
+// signature lasts until the next quote, or until the end of the mail.
+func splitTextBlocks(text string) (blocks []textBlock) {
+	lines := strings.Split(text, "\n")
+	add := func(kind int, line string) {
+		if len(blocks) == 0 || blocks[len(blocks)-1].kind != kind {
+			blocks = append(blocks, textBlock{kind: kind})
+		}
+		blocks[len(blocks)-1].lines = append(blocks[len(blocks)-1].lines, line)
+	}
+	inSignature := false
+	for i := 0; i < len(lines); i++ {
+		if isOutlookSeparator(lines, i) {
+			for ; i < len(lines); i++ {
+				add(blockQuote, lines[i])
+			}
+			break
+		}
+		if length := attributionLength(lines, i); length > 0 {
+			for end := i + length; i < end; i++ {
+				add(blockQuote, lines[i])
+			}
+			for ; i < len(lines) && (isQuotedLine(lines[i]) || strings.TrimSpace(lines[i]) == ""); i++ {
+				add(blockQuote, lines[i])
+			}
+			i--
+			inSignature = false
+			continue
+		}
+		if isQuotedLine(lines[i]) {
+			add(blockQuote, lines[i])
+			inSignature = false
+			continue
+		}
+		if isSignatureSeparator(lines[i]) {
+			inSignature = true
+		}
+		if inSignature {
+			add(blockSignature, lines[i])
+		} else {
+			add(blockText, lines[i])
+		}
+	}
+	return
+}
+
+// foldQuotedText returns the given plain text mail body as HTML.  Quoted
+// blocks (including their attribution lines) and signatures are wrapped in
+// <details> elements so that they are collapsed in the browser.  The result
+// is meant to be placed in an element with “white-space: pre-wrap”.  The
+// line structure is kept: the line break between two blocks is the last
+// character of the first one, so that no empty lines appear around the
+// collapsed blocks.
+func foldQuotedText(text string) template.HTML {
+	var result strings.Builder
+	blocks := splitTextBlocks(text)
+	for i, block := range blocks {
+		content := strings.Join(block.lines, "\n")
+		if i < len(blocks)-1 {
+			content += "\n"
+		}
+		content = template.HTMLEscapeString(content)
+		switch block.kind {
+		case blockQuote:
+			result.WriteString(`<details class="quote"><summary>quoted text</summary>` + content + "</details>")
+		case blockSignature:
+			result.WriteString(`<details class="signature"><summary>signature</summary>` + content + "</details>")
+		default:
+			result.WriteString(content)
+		}
+	}
+	return template.HTML(result.String())
+}
+
+// hasClass returns whether the given HTML element has one of the given CSS
+// classes.
+func hasClass(node *html.Node, classes ...string) bool {
+	for _, attribute := range node.Attr {
+		if attribute.Key == "class" {
+			for _, class := range strings.Fields(attribute.Val) {
+				for _, candidate := range classes {
+					if class == candidate {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// getAttribute returns the value of the given attribute of an HTML element,
+// or the empty string if it is not set.
+func getAttribute(node *html.Node, key string) string {
+	for _, attribute := range node.Attr {
+		if attribute.Key == key {
+			return attribute.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the concatenated text nodes below the given HTML node.
+func textContent(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	var result strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		result.WriteString(textContent(child))
+	}
+	return result.String()
+}
+
+// previousElement returns the previous sibling of the given node which is an
+// element, skipping white space.  It returns nil if there is none.
+func previousElement(node *html.Node) *html.Node {
+	for sibling := node.PrevSibling; sibling != nil; sibling = sibling.PrevSibling {
+		if sibling.Type == html.ElementNode {
+			return sibling
+		}
+		if sibling.Type == html.TextNode && strings.TrimSpace(sibling.Data) != "" {
+			return nil
+		}
+	}
+	return nil
+}
+
+// wrapInDetails moves the given sibling nodes into a new <details> element
+// with the given class and summary, which takes their place in the tree.
+func wrapInDetails(nodes []*html.Node, class, summary string) {
+	details := &html.Node{Type: html.ElementNode, DataAtom: atom.Details, Data: "details",
+		Attr: []html.Attribute{{Key: "class", Val: class}}}
+	summaryNode := &html.Node{Type: html.ElementNode, DataAtom: atom.Summary, Data: "summary"}
+	summaryNode.AppendChild(&html.Node{Type: html.TextNode, Data: summary})
+	details.AppendChild(summaryNode)
+	nodes[0].Parent.InsertBefore(details, nodes[0])
+	for _, node := range nodes {
+		node.Parent.RemoveChild(node)
+		details.AppendChild(node)
+	}
+}
+
+// foldHTMLQuotes wraps citations and signatures in the given HTML tree in
+// <details> elements so that they are collapsed in the browser.  Citations are
+// <blockquote> elements (together with an attribution right before them), the
+// quote containers of Gmail, and everything after Outlook’s reply header.
+// Signatures are detected by the markup of Thunderbird and Gmail.
+func foldHTMLQuotes(root *html.Node) {
+	type fold struct {
+		nodes          []*html.Node
+		class, summary string
+	}
+	var folds []fold
+	var crawler func(*html.Node)
+	crawler = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			switch {
+			case node.DataAtom == atom.Blockquote || hasClass(node, "gmail_quote"):
+				nodes := []*html.Node{node}
+				if previous := previousElement(node); previous != nil &&
+					(hasClass(previous, "moz-cite-prefix", "gmail_attr") ||
+						attributionRegex.MatchString(textContent(previous))) {
+					nodes = []*html.Node{previous, node}
+				}
+				folds = append(folds, fold{nodes, "quote", "quoted text"})
+				return
+			case getAttribute(node, "id") == "divRplyFwdMsg" || getAttribute(node, "id") == "appendonsend":
+				var nodes []*html.Node
+				if previous := previousElement(node); previous != nil && previous.DataAtom == atom.Hr {
+					nodes = append(nodes, previous)
+				}
+				for sibling := node; sibling != nil; sibling = sibling.NextSibling {
+					nodes = append(nodes, sibling)
+				}
+				folds = append(folds, fold{nodes, "quote", "quoted text"})
+				return
+			case hasClass(node, "moz-signature", "gmail_signature"):
+				folds = append(folds, fold{[]*html.Node{node}, "signature", "signature"})
+				return
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			crawler(child)
+		}
+	}
+	crawler(root)
+	for _, fold := range folds {
+		if fold.nodes[0].Parent != nil {
+			wrapInDetails(fold.nodes, fold.class, fold.summary)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockKinds returns the kinds of all lines of the given blocks as a string
+// with one letter per line: “T” for text, “Q” for quotes, and “S” for
+// signatures.
+func blockKinds(blocks []textBlock) string {
+	var result strings.Builder
+	for _, block := range blocks {
+		letter := map[int]string{blockText: "T", blockQuote: "Q", blockSignature: "S"}[block.kind]
+		result.WriteString(strings.Repeat(letter, len(block.lines)))
+	}
+	return result.String()
+}
+
+func TestSplitTextBlocks(t *testing.T) {
+	for _, test := range []struct {
+		name, text, kinds string
+	}{
+		{"plain text", "Hello\nworld", "TT"},
+		{"quoted lines", "Hi\n> quote\n  > indented quote\nreply", "TQQT"},
+		{"English attribution", "Hi\n\nOn Monday, Bob wrote:\n> quote", "TTQQ"},
+		{"attribution before empty line", "On Monday, Bob wrote:\n\n> quote", "QQQ"},
+		{"wrapped German attribution", "Am 01.01.2024 um 10:00 schrieb\nBob <bob@example.com>:\n> Zitat", "QQQ"},
+		{"French attribution", "Le 1 janv. 2024, Bob a écrit :\n> citation", "QQ"},
+		{"Spanish attribution", "El lunes, Bob escribió:\n> cita", "QQ"},
+		{"Dutch attribution", "Op 1 jan. 2024 schreef Bob:\n> citaat", "QQ"},
+		{"Polish attribution", "W dniu 1.01.2024 Bob pisze:\n> cytat", "QQ"},
+		{"attribution without quote", "On Monday, we wrote:\nthe report", "TT"},
+		{"signature", "Hi\n-- \nBob\nExample Inc.", "TSSS"},
+		{"signature without space", "Hi\n--\nBob", "TSS"},
+		{"signature ended by quote", "Hi\n-- \nBob\n> quote\nreply", "TSSQT"},
+		{"dashes in text", "Hi\n-- not a signature\nBye", "TTT"},
+		{"Outlook separator", "Hi\n-----Original Message-----\nFrom: Bob\nhello", "TQQQ"},
+		{"German Outlook separator", "Hi\n-----Ursprüngliche Nachricht-----\nVon: Bob", "TQQ"},
+		{"Outlook header", "Hi\nVon: Bob\nGesendet: Montag\nText", "TQQQ"},
+		{"underscore line", "Hi\n" + strings.Repeat("_", 32) + "\nFrom: Bob", "TQQ"},
+		{"From without Sent", "From: my point of view\nthis is fine", "TT"},
+		{"greater-than in text", "a > b is true", "T"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if kinds := blockKinds(splitTextBlocks(test.text)); kinds != test.kinds {
+				t.Errorf("kinds %v, expected %v", kinds, test.kinds)
+			}
+		})
+	}
+}
+
+func TestFoldQuotedText(t *testing.T) {
+	for _, test := range []struct {
+		name, text, html string
+	}{
+		{"nothing to fold", "Hello\n\nworld <b>\n", "Hello\n\nworld &lt;b&gt;\n"},
+		{"quote", "Hi\n> q\nBye",
+			"Hi\n" + `<details class="quote"><summary>quoted text</summary>&gt; q` + "\n</details>Bye"},
+		{"signature", "Hi\n-- \nBob",
+			"Hi\n" + `<details class="signature"><summary>signature</summary>-- ` + "\nBob</details>"},
+		{"quote at start", "> q\nBye",
+			`<details class="quote"><summary>quoted text</summary>&gt; q` + "\n</details>Bye"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if result := string(foldQuotedText(test.text)); result != test.html {
+				t.Errorf("got %q, expected %q", result, test.html)
+			}
+		})
+	}
+}
+
+// foldHTML parses the given HTML body, folds its quotes, and returns the
+// rendered body content.
+func foldHTML(t *testing.T, body string) string {
+	t.Helper()
+	nodes, err := html.ParseFragment(strings.NewReader(body),
+		&html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	for _, node := range nodes {
+		root.AppendChild(node)
+	}
+	foldHTMLQuotes(root)
+	var result strings.Builder
+	for child := root.FirstChild; child != nil; child = child.NextSibling {
+		if err := html.Render(&result, child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result.String()
+}
+
+func TestFoldHTMLQuotes(t *testing.T) {
+	const quoteStart = `<details class="quote"><summary>quoted text</summary>`
+	for _, test := range []struct {
+		name, body, folded string
+	}{
+		{"blockquote",
+			`<p>Hi</p><blockquote>q</blockquote>`,
+			`<p>Hi</p>` + quoteStart + `<blockquote>q</blockquote></details>`},
+		{"Thunderbird attribution",
+			`<p>Hi</p><div class="moz-cite-prefix">On Monday, Bob wrote:</div> <blockquote>q</blockquote>`,
+			`<p>Hi</p>` + quoteStart + `<div class="moz-cite-prefix">On Monday, Bob wrote:</div>` +
+				`<blockquote>q</blockquote></details> `},
+		{"attribution paragraph",
+			`<p>Am Montag schrieb Bob:</p><blockquote>q</blockquote>`,
+			quoteStart + `<p>Am Montag schrieb Bob:</p><blockquote>q</blockquote></details>`},
+		{"nested blockquotes",
+			`<blockquote>a<blockquote>b</blockquote></blockquote>`,
+			quoteStart + `<blockquote>a<blockquote>b</blockquote></blockquote></details>`},
+		{"Gmail quote",
+			`<div dir="ltr">Hi</div><div class="gmail_quote">q</div>`,
+			`<div dir="ltr">Hi</div>` + quoteStart + `<div class="gmail_quote">q</div></details>`},
+		{"Outlook reply header",
+			`<p>Hi</p><hr><div id="divRplyFwdMsg">From: Bob</div><p>old</p>`,
+			`<p>Hi</p>` + quoteStart + `<hr/><div id="divRplyFwdMsg">From: Bob</div><p>old</p></details>`},
+		{"signature",
+			`<p>Hi</p><div class="moz-signature">Bob</div>`,
+			`<p>Hi</p><details class="signature"><summary>signature</summary>` +
+				`<div class="moz-signature">Bob</div></details>`},
+		{"nothing to fold",
+			`<p>On Monday we met.</p><p>a &gt; b</p><div class="quote">c</div>`,
+			`<p>On Monday we met.</p><p>a &gt; b</p><div class="quote">c</div>`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if folded := foldHTML(t, test.body); folded != test.folded {
+				t.Errorf("got\n%v\nexpected\n%v", folded, test.folded)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/beego/beego/v2/server/web/context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// failureWindow is the time window in which failed accesses are counted.
+	failureWindow = time.Minute
+	// initialLockout is the duration of the first lockout of a client.  Every
+	// further lockout doubles it, up to maxLockout.
+	initialLockout = time.Minute
+	maxLockout     = 24 * time.Hour
+	// globalLockout is the duration of every global lockout.  It does not
+	// grow, because any client can trigger it.
+	globalLockout = time.Minute
+	// maxFailureRecords is the number of per-IP records above which stale
+	// records are purged.
+	maxFailureRecords = 10_000
+)
+
+// failureRecord counts the failed accesses of one client, or of all clients
+// together.
+type failureRecord struct {
+	count       int
+	windowStart time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+var (
+	perIPFailureLimit  int
+	globalFailureLimit int
+	failures           map[string]*failureRecord
+	globalFailures     failureRecord
+	failuresLock       sync.Mutex
+	// allowedNetworks has its own lock because it is read for every
+	// request.
+	allowedNetworks     []*net.IPNet
+	allowedNetworksLock sync.RWMutex
+)
+
+var (
+	accessFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_access_failures_total",
+		Help: "Number of requests with unknown hash IDs or invalid tokens.",
+	}, []string{"status"})
+	lockoutsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_lockouts_total",
+		Help: "Number of lockouts because of too many failed requests, per scope (“ip” or “global”).",
+	}, []string{"scope"})
+	rateLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mail2web_rate_limited_requests_total",
+		Help: "Number of requests rejected with HTTP 429, per scope (“ip” or “global”).",
+	}, []string{"scope"})
+)
+
+// register counts one failure.  If the limit within failureWindow is
+// exceeded, a lockout is started.  Its duration starts at initialLockout and
+// doubles with every lockout up to “maximum”, unless the previous one ended
+// more than maxLockout ago.  It returns the duration of the new lockout, or
+// zero.
+func (record *failureRecord) register(now time.Time, limit int, maximum time.Duration) time.Duration {
+	if now.Sub(record.windowStart) > failureWindow {
+		record.count = 0
+		record.windowStart = now
+	}
+	record.count++
+	if record.count <= limit {
+		return 0
+	}
+	if now.Sub(record.lockedUntil) > maxLockout {
+		record.lockouts = 0
+	}
+	record.lockouts++
+	duration := initialLockout
+	for i := 1; i < record.lockouts && duration < maximum; i++ {
+		duration *= 2
+	}
+	if duration > maximum {
+		duration = maximum
+	}
+	record.lockedUntil = now.Add(duration)
+	record.count = 0
+	return duration
+}
+
+// allowListed returns whether the given client IP is exempt from rate
+// limiting.
+func allowListed(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	allowedNetworksLock.RLock()
+	defer allowedNetworksLock.RUnlock()
+	for _, network := range allowedNetworks {
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeFailureRecords removes records which are neither locked nor have
+// recent failures.  The caller must hold the failures lock.
+func purgeFailureRecords(now time.Time) {
+	for ip, record := range failures {
+		if now.Sub(record.windowStart) > failureWindow && now.Sub(record.lockedUntil) > maxLockout {
+			delete(failures, ip)
+		}
+	}
+}
+
+// registerFailure counts a request with an unknown hash ID or an invalid
+// token for the rate limiting.  “status” is the HTTP status code of the
+// response.
+func registerFailure(controller *web.Controller, status string) {
+	accessFailuresCounter.WithLabelValues(status).Inc()
+	ip := clientIP(controller.Ctx)
+	if allowListed(ip) {
+		return
+	}
+	now := time.Now()
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	record := failures[ip]
+	if record == nil {
+		if len(failures) >= maxFailureRecords {
+			purgeFailureRecords(now)
+		}
+		record = &failureRecord{}
+		failures[ip] = record
+	}
+	if duration := record.register(now, perIPFailureLimit, maxLockout); duration != 0 {
+		lockoutsCounter.WithLabelValues("ip").Inc()
+		logger.Printf("Locked out %v for %v because of too many failed requests", ip, duration)
+	}
+	if duration := globalFailures.register(now, globalFailureLimit, globalLockout); duration != 0 {
+		lockoutsCounter.WithLabelValues("global").Inc()
+		logger.Printf("Locked out all clients for %v because of too many failed requests", duration)
+	}
+}
+
+// isPublicPath returns whether the path is one of the endpoints accessible
+// without login, i.e. the ones guarded by hash IDs and tokens only.
+func isPublicPath(path string) bool {
+	if isMonitoringPath(path) {
+		return false
+	}
+	return !strings.HasPrefix(path, "/restricted/") && !strings.HasPrefix(path, "/api/v1/restricted/")
+}
+
+// rateLimitFilter rejects requests of locked out clients with HTTP 429.  A
+// global lockout affects only the public endpoints, so that logged-in users
+// can still work.
+func rateLimitFilter(ctx *context.Context) {
+	path := ctx.Request.URL.Path
+	if isMonitoringPath(path) {
+		return
+	}
+	ip := clientIP(ctx)
+	if allowListed(ip) {
+		return
+	}
+	now := time.Now()
+	var lockedUntil time.Time
+	var scope string
+	failuresLock.Lock()
+	if record := failures[ip]; record != nil && now.Before(record.lockedUntil) {
+		lockedUntil, scope = record.lockedUntil, "ip"
+	} else if now.Before(globalFailures.lockedUntil) && isPublicPath(path) {
+		lockedUntil, scope = globalFailures.lockedUntil, "global"
+	}
+	failuresLock.Unlock()
+	if scope == "" {
+		return
+	}
+	rateLimitedCounter.WithLabelValues(scope).Inc()
+	ctx.Output.Header("Retry-After", strconv.Itoa(int(lockedUntil.Sub(now).Seconds())+1))
+	writeError(ctx, 429, "Too many failed requests, please try again later.")
+}
+
+// parseNetworks parses a list of networks in CIDR notation.  Single IP
+// addresses are accepted, too.
+func parseNetworks(networks []string) (result []*net.IPNet, err error) {
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, parsedNetwork, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		result = append(result, parsedNetwork)
+	}
+	return result, nil
+}
+
+// setUpRateLimiting takes the limits and the exempt networks from the
+// configuration.
+func setUpRateLimiting(config *config) {
+	networks, err := parseNetworks(config.RateLimitAllow)
+	check(err)
+	failuresLock.Lock()
+	perIPFailureLimit = config.RateLimitPerIP
+	globalFailureLimit = config.RateLimitGlobal
+	failuresLock.Unlock()
+	allowedNetworksLock.Lock()
+	allowedNetworks = networks
+	allowedNetworksLock.Unlock()
+}
+
+func init() {
+	failures = make(map[string]*failureRecord)
+	web.InsertFilter("*", web.BeforeRouter, rateLimitFilter)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// currentConfig is the configuration in effect.  It is only accessed
+	// under reloadLock after start-up.
+	currentConfig *config
+	reloadLock    sync.Mutex
+	// settingsLock protects the settings which can be changed at runtime:
+	// includedDirs, myMailsWindow, smtpHost, envelopeSender, and
+	// requestMailTemplate.  The rate limits are protected by failuresLock, the
+	// networks exempt from them by allowedNetworksLock, and the trusted
+	// proxies by trustedProxiesLock.
+	settingsLock sync.RWMutex
+)
+
+// keepUnreloadableSettings copies all settings which cannot be changed at
+// runtime from “old” to “new”.  It returns the YAML keys of those which
+// differed.
+func keepUnreloadableSettings(old, new *config) (changed []string) {
+	configType := reflect.TypeOf(*old)
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if !field.IsExported() || field.Tag.Get("reload") != "" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, field.Tag.Get("yaml"))
+			newValue.Field(i).Set(oldValue.Field(i))
+		}
+	}
+	return changed
+}
+
+// addFolder starts watching the given mail folder and indexes its mails.
+func addFolder(folder string) {
+	if err := mailWatcher.Add(filepath.Join(mailDir, folder)); err != nil {
+		logger.Printf("Could not add folder %v: %v", folder, err)
+		return
+	}
+	var progress indexingProgress
+	if err := populateGlobalMaps([]string{folder}, &progress); err != nil {
+		logger.Printf("Could not index folder %v: %v", folder, err)
+		return
+	}
+	logger.Printf("Added folder %v with %v mails", folder, progress.filesIndexed.Load())
+}
+
+// removeFolder stops watching the given mail folder and removes its mails from
+// the index.
+func removeFolder(folder string) {
+	absDir := filepath.Join(mailDir, folder)
+	if err := mailWatcher.Remove(absDir); err != nil {
+		logger.Printf("Could not stop watching folder %v: %v", folder, err)
+	}
+	var hashIDs []hashID
+	mailPathsLock.RLock()
+	for hashID, path := range mailPaths {
+		if filepath.Dir(path) == absDir {
+			hashIDs = append(hashIDs, hashID)
+		}
+	}
+	mailPathsLock.RUnlock()
+	for _, hashID := range hashIDs {
+		unindexMail(hashID)
+	}
+	for _, mail := range getQuarantinedMails() {
+		if filepath.Dir(mail.Path) == absDir {
+			releaseFromQuarantine(mail.Path)
+		}
+	}
+	logger.Printf("Removed folder %v with %v mails", folder, len(hashIDs))
+}
+
+// reloadConfig reads the configuration again and applies the settings which
+// can be changed at runtime.  Mail folders which were added are indexed, and
+// the mails of removed folders are removed from the index.  If the new
+// configuration is invalid, the current one is kept.
+func reloadConfig() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		logger.Println("Not reloading invalid configuration:", err)
+		return
+	}
+	if changed := keepUnreloadableSettings(currentConfig, config); len(changed) > 0 {
+		logger.Printf("Changes of %v need a restart; they are ignored", strings.Join(changed, ", "))
+	}
+	if err := setUpMail(config); err != nil {
+		logger.Println("Not reloading invalid configuration:", err)
+		return
+	}
+	setUpTrustedProxies(config)
+	setUpRateLimiting(config)
+	settingsLock.Lock()
+	myMailsWindow = time.Duration(config.MyMailsDays) * 24 * time.Hour
+	includedDirs = config.MailFolders
+	settingsLock.Unlock()
+	oldFolders := make(map[string]bool)
+	for _, folder := range currentConfig.MailFolders {
+		oldFolders[folder] = true
+	}
+	for _, folder := range config.MailFolders {
+		if !oldFolders[folder] {
+			addFolder(folder)
+		}
+		delete(oldFolders, folder)
+	}
+	for folder := range oldFolders {
+		removeFolder(folder)
+	}
+	currentConfig = config
+	logger.Println("Reloaded configuration")
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the
+// configuration file changes.  It never returns.
+func watchConfig() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	var events chan fsnotify.Event
+	var errors chan error
+	if currentConfig.path != "" {
+		watcher, err := fsnotify.NewWatcher()
+		check(err)
+		// The directory is watched because editors often replace the file.
+		check(watcher.Add(filepath.Dir(currentConfig.path)))
+		events, errors = watcher.Events, watcher.Errors
+	}
+	configPath := filepath.Clean(currentConfig.path)
+	for {
+		select {
+		case <-signals:
+			logger.Println("Received SIGHUP")
+			reloadConfig()
+		case event := <-events:
+			if filepath.Clean(event.Name) == configPath &&
+				event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+				reloadConfig()
+			}
+		case err := <-errors:
+			logger.Println("Config watcher:", err)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 Hello {{.loginName}},
 
-your mail can be retrieved by
+your request for the mail
 
-{{.link}}
+{{.messageID}}
 
-The above link will limit the thread to mails older than your mail.
-The following link will also include all future mails to the thread:
+was approved.  The mail can be retrieved by
 
-{{.fullThreadLink}}
+{{.link}}
+{{if eq .mode "direct"}}
+The above link includes the direct parent and children of your mail.
+{{else if eq .mode "older"}}
+The above link includes the thread up to your mail.
+{{else if eq .mode "full"}}
+The above link includes the full thread, including all future mails to it.
+{{end}}{{if .expires}}
+The link is valid until {{.expires}}.
+{{end}}
\ No newline at end of file
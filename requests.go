@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/jhillyerd/enmime"
+	"go4.org/must"
+)
+
+const (
+	requestPending  = "pending"
+	requestApproved = "approved"
+	requestDenied   = "denied"
+)
+
+// linkRequest is a request of a user for the link to a mail, which needs to be
+// approved by the admin.  “Mode” is the access mode chosen by the admin
+// (“single”, “direct”, “older”, or “full”), and “Link” the generated link,
+// relative to the origin the admin approved the request on.  The fields are
+// public because they are used in the HTML views.
+type linkRequest struct {
+	ID        string
+	Login     string
+	MessageID messageID
+	HashID    hashID
+	Created   time.Time
+	Status    string
+	Mode      string
+	Expires   time.Time
+	Link      string
+	Decided   time.Time
+}
+
+// CurrentHashID returns the hash ID of the requested mail with the current
+// key and hash length.  The stored “HashID” may be outdated.
+func (request linkRequest) CurrentHashID() hashID {
+	return messageIDToHashID(request.MessageID)
+}
+
+var (
+	linkRequestsPath string
+	linkRequests     []linkRequest
+	linkRequestsLock sync.RWMutex
+)
+
+// accessModeNames maps the names of the access modes used in the admin page
+// to the access modes.
+var accessModeNames = map[string]int{
+	"single": accessSingle,
+	"direct": accessDirect,
+	"older":  accessOlder,
+	"full":   accessFull,
+}
+
+// saveLinkRequests writes all link requests to disk, one JSON object per line.
+// The caller must hold the link requests lock.
+func saveLinkRequests() {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, request := range linkRequests {
+		check(encoder.Encode(request))
+	}
+	err := os.WriteFile(linkRequestsPath+".tmp", data.Bytes(), 0o600)
+	check(err)
+	err = os.Rename(linkRequestsPath+".tmp", linkRequestsPath)
+	check(err)
+}
+
+// addLinkRequest stores a new pending request of the user for the given mail.
+// If the user has already a pending request for this mail, it is returned
+// instead.
+func addLinkRequest(login string, messageID messageID, hashID hashID) (request linkRequest, isNew bool) {
+	linkRequestsLock.Lock()
+	defer linkRequestsLock.Unlock()
+	for _, request := range linkRequests {
+		if request.Login == login && request.MessageID == messageID && request.Status == requestPending {
+			return request, false
+		}
+	}
+	randomBytes := make([]byte, 8)
+	_, err := rand.Read(randomBytes)
+	check(err)
+	request = linkRequest{
+		ID:        fmt.Sprintf("%x", randomBytes),
+		Login:     login,
+		MessageID: messageID,
+		HashID:    hashID,
+		Created:   time.Now(),
+		Status:    requestPending,
+	}
+	linkRequests = append(linkRequests, request)
+	saveLinkRequests()
+	return request, true
+}
+
+// accessLink returns the link to the given mail with the given access mode,
+// relative to mail2web’s root.  Links with single access mode cannot expire.
+func accessLink(hashID hashID, messageID messageID, accessMode int, expires time.Time) string {
+	var token string
+	if accessMode != accessSingle {
+		token = makeToken(messageID, accessModeName(accessMode), expires)
+	}
+	return fmt.Sprintf("/%v%v", hashID, accessQueryString(accessMode, token))
+}
+
+// decideLinkRequest approves or denies the pending request with the given ID.
+// It returns the updated request, or an error if there is no such pending
+// request.
+func decideLinkRequest(id string, approve bool, mode string, expires time.Time) (linkRequest, error) {
+	linkRequestsLock.Lock()
+	defer linkRequestsLock.Unlock()
+	for i := range linkRequests {
+		request := &linkRequests[i]
+		if request.ID != id {
+			continue
+		}
+		if request.Status != requestPending {
+			return *request, fmt.Errorf("request %v was already %v", id, request.Status)
+		}
+		request.Decided = time.Now()
+		if approve {
+			request.Status = requestApproved
+			request.Mode = mode
+			if accessModeNames[mode] != accessSingle {
+				request.Expires = expires
+			}
+			request.Link = accessLink(request.CurrentHashID(), request.MessageID, accessModeNames[mode], request.Expires)
+		} else {
+			request.Status = requestDenied
+		}
+		saveLinkRequests()
+		return *request, nil
+	}
+	return linkRequest{}, fmt.Errorf("request %v not found", id)
+}
+
+// notifyRequester sends the decision about the request to the user who made
+// it.  For approved requests, the mail is rendered from requestMail.tpl.
+// “root” is the absolute URL of mail2web’s root.
+func notifyRequester(request linkRequest, root string) error {
+	address := getEmailAddress(request.Login)
+	if address == "" {
+		return fmt.Errorf("email address of %v not found", request.Login)
+	}
+	settingsLock.RLock()
+	template, sender := requestMailTemplate, envelopeSender
+	settingsLock.RUnlock()
+	var text bytes.Buffer
+	subject := "Your request for mail " + string(request.MessageID)
+	if request.Status == requestApproved {
+		var expires string
+		if !request.Expires.IsZero() {
+			expires = request.Expires.Format("2006-01-02")
+		}
+		err := template.Execute(&text, map[string]string{
+			"loginName": request.Login,
+			"messageID": string(request.MessageID),
+			"link":      root + request.Link,
+			"mode":      request.Mode,
+			"expires":   expires,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(&text, "Hello %v,\n\nyour request for the mail\n\n%v\n\nwas denied.\n",
+			request.Login, request.MessageID)
+	}
+	part, err := enmime.Builder().
+		From("mail2web", sender).
+		To("", address).
+		Subject(subject).
+		Text(text.Bytes()).
+		Build()
+	if err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if err := part.Encode(&content); err != nil {
+		return err
+	}
+	return sendMail([]string{address}, content.Bytes())
+}
+
+// checkAdmin triggers an HTTP 403 if the logged-in user is not the admin.
+func checkAdmin(controller *web.Controller) {
+	loginName := getLogin(controller)
+	if permissions.Admin == "" || loginName != permissions.Admin {
+		denyAccess(controller, "403", "Denied access to admin page for %v", loginName)
+	}
+}
+
+type AdminRequestsController struct {
+	web.Controller
+}
+
+// Controller for the list of link requests.  Pending requests come first, the
+// rest is sorted newest first.
+func (this *AdminRequestsController) Get() {
+	checkAdmin(&this.Controller)
+	linkRequestsLock.RLock()
+	requests := make([]linkRequest, len(linkRequests))
+	copy(requests, linkRequests)
+	linkRequestsLock.RUnlock()
+	sort.SliceStable(requests, func(i, j int) bool {
+		iPending, jPending := requests[i].Status == requestPending, requests[j].Status == requestPending
+		if iPending != jPending {
+			return iPending
+		}
+		return requests[i].Created.After(requests[j].Created)
+	})
+	this.TplName = "adminRequests.tpl"
+	this.Data["requests"] = requests
+	this.Data["rooturl"] = basePath(this.Ctx)
+	this.Data["csrf"] = csrfToken(getLogin(&this.Controller))
+}
+
+// Controller for approving or denying a link request.  The form fields are
+// “id”, “action” (“approve” or “deny”), “mode” (“single”, “direct”, “older”,
+// or “full”), and “expires” (optional, YYYY-MM-DD).  The requester is notified
+// by mail.
+func (this *AdminRequestsController) Post() {
+	checkAdmin(&this.Controller)
+	action := this.GetString("action")
+	if action != "approve" && action != "deny" {
+		this.Abort("400")
+	}
+	mode := this.GetString("mode", "older")
+	if _, ok := accessModeNames[mode]; !ok {
+		this.Abort("400")
+	}
+	var expires time.Time
+	if rawExpires := this.GetString("expires"); rawExpires != "" {
+		var err error
+		expires, err = time.ParseInLocation("2006-01-02", rawExpires, time.Local)
+		if err != nil {
+			this.Abort("400")
+		}
+	}
+	request, err := decideLinkRequest(this.GetString("id"), action == "approve", mode, expires)
+	if err != nil {
+		logger.Println(err)
+		this.Abort("404")
+	}
+	record := newAuditRecord(&this.Controller, auditAllowed)
+	record.Event = "request_" + request.Status
+	record.Reason = fmt.Sprintf("request %v of %v", request.ID, request.Login)
+	record.HashID = request.CurrentHashID()
+	record.MessageID = request.MessageID
+	record.AccessMode = request.Mode
+	writeAuditRecord(record)
+	if err := notifyRequester(request, mailRoot(this.Ctx)); err != nil {
+		logger.Printf("Could not notify %v about request %v: %v", request.Login, request.ID, err)
+	}
+	this.Redirect(basePath(this.Ctx)+"/restricted/admin/requests", 303)
+}
+
+// loadLinkRequests reads the link requests stored in the state directory.
+func loadLinkRequests(config *config) {
+	linkRequestsPath = filepath.Join(config.StatePath, "requests.jsonl")
+	file, err := os.Open(linkRequestsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	check(err)
+	defer must.Close(file)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var request linkRequest
+		err := json.Unmarshal(scanner.Bytes(), &request)
+		check(err)
+		linkRequests = append(linkRequests, request)
+	}
+	check(scanner.Err())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLinkRequestWithOldHashLength(t *testing.T) {
+	const messageID = "reply2@example.com"
+	current := testHashID(messageID)
+	linkRequestsLock.Lock()
+	oldLinkRequests := linkRequests
+	// The request was made when hash IDs were longer.
+	linkRequests = []linkRequest{{ID: "0123456789abcdef", Login: "alice", MessageID: messageID,
+		HashID: longHashID(messageID), Status: requestPending}}
+	linkRequestsLock.Unlock()
+	t.Cleanup(func() {
+		linkRequestsLock.Lock()
+		linkRequests = oldLinkRequests
+		saveLinkRequests()
+		linkRequestsLock.Unlock()
+	})
+
+	if _, isNew := addLinkRequest("alice", messageID, current); isNew {
+		t.Error("duplicate request was added")
+	}
+	request := httptest.NewRequest(http.MethodGet, "/restricted/admin/requests", nil)
+	request.SetBasicAuth("admin", "")
+	response := serve(request)
+	if !strings.Contains(response.Body.String(), `href="/`+string(current)+`"`) {
+		t.Errorf("admin page lacks the link with the current hash ID: %s", response.Body.Bytes())
+	}
+	form := url.Values{"id": {"0123456789abcdef"}, "action": {"approve"}, "mode": {"full"},
+		"csrf": {csrfToken("admin")}}
+	request = httptest.NewRequest(http.MethodPost, "/restricted/admin/requests", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("admin", "")
+	if response := serve(request); response.Code != http.StatusSeeOther {
+		t.Fatalf("status %v: %s", response.Code, response.Body.Bytes())
+	}
+	linkRequestsLock.RLock()
+	link := linkRequests[0].Link
+	linkRequestsLock.RUnlock()
+	if !strings.HasPrefix(link, "/"+string(current)+"?") {
+		t.Errorf("link %v does not use the current hash ID", link)
+	}
+	records, err := readAuditLog(func(record auditRecord) bool {
+		return record.Event == "request_approved" && record.MessageID == messageID
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || records[len(records)-1].HashID != current {
+		t.Errorf("audit records %v lack the current hash ID", records)
+	}
+}
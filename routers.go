@@ -2,14 +2,33 @@ package main
 
 import (
 	"github.com/beego/beego/v2/server/web"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func init() {
+	web.InsertFilterChain("*", stripRootURL)
+	web.ErrorController(&ErrorController{})
 	web.Router("/:hash/?:messageid/:index:int", &AttachmentController{})
 	web.Router("/:hash/?:messageid/img/:cid", &ImageController{})
 	web.Router("/:hash/?:messageid", &MainController{})
 	web.Router("/restricted/:hash/?:messageid/send", &SendController{})
+	web.Router("/restricted/:hash/?:messageid/subscribe", &SubscribeController{})
+	web.Router("/restricted/:hash/?:messageid/unsubscribe", &UnsubscribeController{})
 	web.Router("/restricted/my_mails", &MyMailsController{})
 	web.Router("/restricted/request/?:messageid", &MailRequestController{})
+	web.Router("/restricted/admin/requests", &AdminRequestsController{})
+	web.Router("/restricted/admin/audit", &AdminAuditController{})
+	web.Router("/restricted/admin/quarantine", &AdminQuarantineController{})
 	web.Router("/healthz", &HealthController{})
+	web.Router("/livez", &LivenessController{})
+	web.Router("/readyz", &ReadinessController{})
+	web.Router("/auth/login", &OIDCLoginController{})
+	web.Router("/auth/callback", &OIDCCallbackController{})
+	web.Router("/auth/logout", &LogoutController{})
+	web.Handler("/metrics", promhttp.Handler())
+	web.Router("/feed/:hash", &FeedController{})
+	web.Router("/events/:hash", &EventsController{})
+	web.Router("/api/v1/mails/:hash/?:messageid", &APIMailController{})
+	web.Router("/api/v1/restricted/my_mails", &APIMyMailsController{})
+	web.Router("/api/v1/restricted/search", &APISearchController{})
 }
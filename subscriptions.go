@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/jhillyerd/enmime"
+)
+
+const (
+	notifyImmediately = "immediate"
+	notifyDigest      = "digest"
+)
+
+// subscription is a logged-in user following a thread.  The notifications
+// link to new mails through the origin mail, with a tokenFull expiring like
+// the one the user subscribed with.  The origin mail is stored by its message
+// ID, so that subscriptions survive changes of the hash length and the key;
+// “OriginHashID” is only needed for subscriptions stored before.  “Origin” is
+// the absolute URL of the mail2web root, as seen by the user when
+// subscribing.
+type subscription struct {
+	Login           string
+	OriginMessageID messageID
+	OriginHashID    hashID
+	Token           string
+	Origin          string
+	Mode            string
+	Created         time.Time
+}
+
+// originHashID returns the current hash ID of the origin mail.
+func (subscription subscription) originHashID() hashID {
+	if subscription.OriginMessageID != "" {
+		return messageIDToHashID(subscription.OriginMessageID)
+	}
+	return currentHashID(subscription.OriginHashID)
+}
+
+// originMessageID returns the message ID of the origin mail, or an empty
+// string if it is unknown.
+func (subscription subscription) originMessageID() messageID {
+	if subscription.OriginMessageID != "" {
+		return subscription.OriginMessageID
+	}
+	mailInfosLock.RLock()
+	defer mailInfosLock.RUnlock()
+	return mailInfos[subscription.originHashID()].MessageID
+}
+
+// token returns the tokenFull for the origin mail with the current key and
+// hash length.  It expires like the token the user subscribed with.
+func (subscription subscription) token() string {
+	expires, err := tokenExpiry(subscription.Token)
+	messageID := subscription.originMessageID()
+	if err != nil || messageID == "" {
+		return subscription.Token
+	}
+	return makeToken(messageID, "full", expires)
+}
+
+// pendingNotification is a new mail in a followed thread that has not yet been
+// sent to the subscriber.  The fields are public because the pending
+// notifications are stored on disk.
+type pendingNotification struct {
+	Subscription subscription
+	MailInfo     mailInfo
+	Since        time.Time
+}
+
+// notificationsState is the content of the file with the pending
+// notifications, so that they survive restarts.
+type notificationsState struct {
+	Pending     map[string][]pendingNotification
+	LastDigests map[string]time.Time
+}
+
+const (
+	// notificationBatchDelay is the time immediate notifications are
+	// collected in order to send them in one mail.
+	notificationBatchDelay = 5 * time.Minute
+	digestInterval         = 24 * time.Hour
+	notificationInterval   = time.Minute
+)
+
+var (
+	subscriptionsPath    string
+	notificationsPath    string
+	subscriptions        []subscription
+	pendingNotifications map[string][]pendingNotification
+	lastDigests          map[string]time.Time
+	subscriptionsLock    sync.RWMutex
+)
+
+// saveSubscriptions writes all subscriptions to disk.  The caller must hold
+// the subscriptions lock.
+func saveSubscriptions() {
+	data, err := json.MarshalIndent(subscriptions, "", "  ")
+	check(err)
+	err = os.WriteFile(subscriptionsPath+".tmp", data, 0o600)
+	check(err)
+	err = os.Rename(subscriptionsPath+".tmp", subscriptionsPath)
+	check(err)
+}
+
+// savePendingNotifications writes the pending notifications and the times of
+// the last digests to disk.  Errors are only logged, so that notifications
+// are still sent.  The caller must hold the subscriptions lock.
+func savePendingNotifications() {
+	data, err := json.MarshalIndent(notificationsState{pendingNotifications, lastDigests}, "", "  ")
+	check(err)
+	if err := os.WriteFile(notificationsPath+".tmp", data, 0o600); err != nil {
+		logger.Println("Could not save pending notifications:", err)
+		return
+	}
+	if err := os.Rename(notificationsPath+".tmp", notificationsPath); err != nil {
+		logger.Println("Could not save pending notifications:", err)
+	}
+}
+
+// subscribe adds or replaces the subscription of the user to the thread.
+func subscribe(newSubscription subscription) {
+	thread := collectThread(newSubscription.originHashID())
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	for i, subscription := range subscriptions {
+		if subscription.Login == newSubscription.Login && thread[subscription.originHashID()] {
+			subscriptions[i] = newSubscription
+			saveSubscriptions()
+			return
+		}
+	}
+	subscriptions = append(subscriptions, newSubscription)
+	saveSubscriptions()
+}
+
+// unsubscribe removes the subscription of the user to the thread of the given
+// mail, if any.
+func unsubscribe(login string, hashID hashID) {
+	thread := collectThread(hashID)
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	for i, subscription := range subscriptions {
+		if subscription.Login == login && thread[subscription.originHashID()] {
+			subscriptions = append(subscriptions[:i], subscriptions[i+1:]...)
+			saveSubscriptions()
+			return
+		}
+	}
+}
+
+// subscriptionsExist returns whether any user follows any thread.
+func subscriptionsExist() bool {
+	subscriptionsLock.RLock()
+	defer subscriptionsLock.RUnlock()
+	return len(subscriptions) > 0
+}
+
+// queueNotifications records the given event for all users following its
+// thread.  Only added mails are of interest, and users are not notified about
+// their own mails.  The pending notifications are saved to disk.
+func queueNotifications(event threadEvent) {
+	if event.removed {
+		return
+	}
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	queued := false
+	for _, subscription := range subscriptions {
+		if !event.thread[subscription.originHashID()] {
+			continue
+		}
+		address := getEmailAddress(subscription.Login)
+		if address != "" && strings.Contains(strings.ToLower(event.From), strings.ToLower(address)) {
+			continue
+		}
+		if subscription.Mode == notifyDigest && lastDigests[subscription.Login].IsZero() {
+			lastDigests[subscription.Login] = time.Now()
+		}
+		pendingNotifications[subscription.Login] = append(pendingNotifications[subscription.Login],
+			pendingNotification{subscription, event.mailInfo, time.Now()})
+		queued = true
+	}
+	if queued {
+		savePendingNotifications()
+	}
+}
+
+// sendNotification sends one mail listing the given new mails to the user.
+// The mail contains only subject, sender, and link of each mail.
+func sendNotification(login string, notifications []pendingNotification) error {
+	address := getEmailAddress(login)
+	if address == "" {
+		return fmt.Errorf("email address of %v not found", login)
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].MailInfo.Timestamp.Before(notifications[j].MailInfo.Timestamp)
+	})
+	var text strings.Builder
+	fmt.Fprintf(&text, "Hello %v,\n\nthere are new mails in threads you follow:\n", login)
+	for _, notification := range notifications {
+		subscription := notification.Subscription
+		fmt.Fprintf(&text, "\n%v\nfrom %v\n%v/%v%v\n", notification.MailInfo.Subject, notification.MailInfo.From,
+			subscription.Origin, mailLink(subscription.originHashID(), notification.MailInfo.MessageID),
+			accessQueryString(accessFull, subscription.token()))
+	}
+	subject := "New mail in a thread you follow"
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("%v new mails in threads you follow", len(notifications))
+	}
+	settingsLock.RLock()
+	sender := envelopeSender
+	settingsLock.RUnlock()
+	part, err := enmime.Builder().
+		From("mail2web", sender).
+		To("", address).
+		Subject(subject).
+		Text([]byte(text.String())).
+		Build()
+	if err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if err := part.Encode(&content); err != nil {
+		return err
+	}
+	return sendMail([]string{address}, content.Bytes())
+}
+
+// flushNotifications sends all pending notifications that are due.
+// Immediate notifications are due after notificationBatchDelay, so that
+// several of them are sent in one mail.  Digest notifications are sent once
+// per digestInterval.  Notifications are removed from disk only after they
+// have been sent successfully; if sending fails, they are kept pending and
+// the digest time is not advanced, so that they are retried later.
+func flushNotifications() {
+	subscriptionsLock.Lock()
+	due := make(map[string][]pendingNotification)
+	digests := make(map[string]bool)
+	for login, notifications := range pendingNotifications {
+		var remaining []pendingNotification
+		digestDue := time.Since(lastDigests[login]) >= digestInterval
+		for _, notification := range notifications {
+			if notification.Subscription.Mode == notifyDigest {
+				if digestDue {
+					due[login] = append(due[login], notification)
+					digests[login] = true
+				} else {
+					remaining = append(remaining, notification)
+				}
+			} else if time.Since(notification.Since) >= notificationBatchDelay {
+				due[login] = append(due[login], notification)
+			} else {
+				remaining = append(remaining, notification)
+			}
+		}
+		if len(remaining) > 0 {
+			pendingNotifications[login] = remaining
+		} else {
+			delete(pendingNotifications, login)
+		}
+	}
+	subscriptionsLock.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	failed := make(map[string]bool)
+	for login, notifications := range due {
+		if err := sendNotification(login, notifications); err != nil {
+			logger.Printf("Could not send notification to %v: %v", login, err)
+			failed[login] = true
+		}
+	}
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	for login, notifications := range due {
+		if failed[login] {
+			pendingNotifications[login] = append(notifications, pendingNotifications[login]...)
+		} else if digests[login] {
+			lastDigests[login] = time.Now()
+		}
+	}
+	savePendingNotifications()
+}
+
+// runNotifications is a goroutine running for the whole run time of the
+// program.  It periodically sends the pending notifications.
+func runNotifications() {
+	for {
+		time.Sleep(notificationInterval)
+		flushNotifications()
+	}
+}
+
+// getSubscriptionData is a helper for the subscription controllers.  It
+// returns login name and origin mail of the current request, and makes sure
+// that the user has full access to the thread.
+func getSubscriptionData(controller *web.Controller) (loginName string, originMessageID messageID,
+	originHashID hashID, token string) {
+	loginName = getLogin(controller)
+	_, err := userEmailAddress(loginName)
+	abortOnError(controller, err)
+	var accessMode int
+	accessMode, token, _, _, _, originHashID, _, _ = getMailAndThreadRoot(controller)
+	if accessMode != accessFull {
+		denyAccess(controller, "403", "Denied subscription because no tokenFull was given")
+	}
+	mailInfosLock.RLock()
+	originMessageID = mailInfos[originHashID].MessageID
+	mailInfosLock.RUnlock()
+	return
+}
+
+type SubscribeController struct {
+	web.Controller
+}
+
+// Controller for confirming the subscription to the thread of the current
+// email.
+func (this *SubscribeController) Get() {
+	question := "Get a notification by email about every new mail in this thread?"
+	if this.GetString("mode") == notifyDigest {
+		question = "Get a daily digest by email about new mails in this thread?"
+	}
+	confirmAction(&this.Controller, "Thread notifications", question, "Follow thread")
+}
+
+// Controller for following the thread of the current email.  The query
+// parameter “mode” may be “immediate” (the default) or “digest”.
+func (this *SubscribeController) Post() {
+	loginName, originMessageID, originHashID, token := getSubscriptionData(&this.Controller)
+	mode := this.GetString("mode", notifyImmediately)
+	if mode != notifyImmediately && mode != notifyDigest {
+		this.Abort("400")
+	}
+	subscribe(subscription{
+		Login:           loginName,
+		OriginMessageID: originMessageID,
+		OriginHashID:    originHashID,
+		Token:           token,
+		Origin:          mailRoot(this.Ctx),
+		Mode:            mode,
+		Created:         time.Now(),
+	})
+	this.TplName = "subscription.tpl"
+	this.Data["subscribed"] = true
+	this.Data["digest"] = mode == notifyDigest
+	this.Data["address"] = getEmailAddress(loginName)
+	this.Data["rooturl"] = basePath(this.Ctx)
+	this.Data["link"] = template.URL(fmt.Sprintf("%v%v", originHashID, accessQueryString(accessFull, token)))
+}
+
+type UnsubscribeController struct {
+	web.Controller
+}
+
+// Controller for confirming the end of the subscription to the thread of the
+// current email.
+func (this *UnsubscribeController) Get() {
+	confirmAction(&this.Controller, "Thread notifications", "Stop notifications about this thread?",
+		"Stop following")
+}
+
+// Controller for not following the thread of the current email anymore.
+func (this *UnsubscribeController) Post() {
+	loginName, _, originHashID, token := getSubscriptionData(&this.Controller)
+	unsubscribe(loginName, originHashID)
+	this.TplName = "subscription.tpl"
+	this.Data["subscribed"] = false
+	this.Data["rooturl"] = basePath(this.Ctx)
+	this.Data["link"] = template.URL(fmt.Sprintf("%v%v", originHashID, accessQueryString(accessFull, token)))
+}
+
+// loadSubscriptions reads the subscriptions and the pending notifications
+// stored in the state directory.
+func loadSubscriptions(config *config) {
+	subscriptionsPath = filepath.Join(config.StatePath, "subscriptions.json")
+	notificationsPath = filepath.Join(config.StatePath, "notifications.json")
+	pendingNotifications = make(map[string][]pendingNotification)
+	lastDigests = make(map[string]time.Time)
+	data, err := os.ReadFile(subscriptionsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	check(err)
+	err = json.Unmarshal(data, &subscriptions)
+	check(err)
+	data, err = os.ReadFile(notificationsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	check(err)
+	var state notificationsState
+	err = json.Unmarshal(data, &state)
+	check(err)
+	if state.Pending != nil {
+		pendingNotifications = state.Pending
+	}
+	if state.LastDigests != nil {
+		lastDigests = state.LastDigests
+	}
+}
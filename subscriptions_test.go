@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// longHashID returns a hash ID of the given mail which is longer than the
+// current hash length, like the ones issued before hash_length was reduced.
+func longHashID(messageID messageID) hashID {
+	return fullHashWithKey(secretKey, messageID, "")[:hashLength+4]
+}
+
+func TestSubscriptionWithOldHashID(t *testing.T) {
+	expires := time.Now().AddDate(1, 0, 0)
+	legacy := subscription{
+		Login:        "admin",
+		OriginHashID: longHashID("reply1@example.com"),
+		Token:        makeToken("reply1@example.com", "full", expires),
+		Origin:       "https://mails.example.com",
+		Mode:         notifyImmediately,
+	}
+	if hash := legacy.originHashID(); hash != testHashID("reply1@example.com") {
+		t.Errorf("origin hash ID %v was not resolved", hash)
+	}
+	if messageID := legacy.originMessageID(); messageID != "reply1@example.com" {
+		t.Errorf("wrong origin message ID %v", messageID)
+	}
+	if token := legacy.token(); tokenKey(token, "reply1@example.com", "full") == nil {
+		t.Errorf("invalid token %v", token)
+	} else if tokenExpires, _ := tokenExpiry(token); tokenExpires.Format("20060102") != expires.Format("20060102") {
+		t.Errorf("token expires at %v instead of %v", tokenExpires, expires)
+	}
+
+	subscriptionsLock.Lock()
+	oldSubscriptions := subscriptions
+	subscriptions = []subscription{legacy}
+	subscriptionsLock.Unlock()
+	t.Cleanup(func() {
+		subscriptionsLock.Lock()
+		subscriptions = oldSubscriptions
+		delete(pendingNotifications, "admin")
+		subscriptionsLock.Unlock()
+	})
+	hash := testHashID("reply3@example.com")
+	mailInfosLock.RLock()
+	event := threadEvent{mailInfo: mailInfos[hash], thread: collectThread(hash)}
+	mailInfosLock.RUnlock()
+	queueNotifications(event)
+	subscriptionsLock.RLock()
+	pending := len(pendingNotifications["admin"])
+	subscriptionsLock.RUnlock()
+	if pending != 1 {
+		t.Errorf("%v notifications queued for a subscription with an old hash ID", pending)
+	}
+}
+
+func TestWebhookWithOldHashID(t *testing.T) {
+	hash := testHashID("reply3@example.com")
+	event := threadEvent{thread: collectThread(hash)}
+	if !(webhook{Threads: []hashID{longHashID("root@example.com")}}).matches(event) {
+		t.Error("webhook with an old hash ID of the thread root does not match")
+	}
+	if (webhook{Threads: []hashID{longHashID("unknown@example.com")}}).matches(event) {
+		t.Error("webhook with an unknown hash ID matches")
+	}
+}
+
+func TestFailedNotificationsKept(t *testing.T) {
+	settingsLock.Lock()
+	oldSMTPHost := smtpHost
+	// Nothing listens on port 1, so sending fails.
+	smtpHost = "127.0.0.1:1"
+	settingsLock.Unlock()
+	lastDigest := time.Now().Add(-2 * digestInterval)
+	hash := testHashID("reply3@example.com")
+	mailInfosLock.RLock()
+	mail := mailInfos[hash]
+	mailInfosLock.RUnlock()
+	since := time.Now().Add(-2 * notificationBatchDelay)
+	subscriptionsLock.Lock()
+	pendingNotifications["admin"] = []pendingNotification{
+		{Subscription: subscription{Login: "admin", Mode: notifyImmediately}, MailInfo: mail, Since: since},
+		{Subscription: subscription{Login: "admin", Mode: notifyDigest}, MailInfo: mail, Since: since},
+	}
+	lastDigests["admin"] = lastDigest
+	subscriptionsLock.Unlock()
+	t.Cleanup(func() {
+		settingsLock.Lock()
+		smtpHost = oldSMTPHost
+		settingsLock.Unlock()
+		subscriptionsLock.Lock()
+		delete(pendingNotifications, "admin")
+		delete(lastDigests, "admin")
+		savePendingNotifications()
+		subscriptionsLock.Unlock()
+	})
+
+	flushNotifications()
+	subscriptionsLock.RLock()
+	pending, digest := len(pendingNotifications["admin"]), lastDigests["admin"]
+	subscriptionsLock.RUnlock()
+	if pending != 2 {
+		t.Errorf("%v notifications pending after failed sending, expected 2", pending)
+	}
+	if !digest.Equal(lastDigest) {
+		t.Errorf("last digest moved to %v although sending failed", digest)
+	}
+	data, err := os.ReadFile(notificationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state notificationsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Pending["admin"]) != 2 {
+		t.Errorf("%v notifications saved after failed sending, expected 2", len(state.Pending["admin"]))
+	}
+}
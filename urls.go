@@ -0,0 +1,89 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/beego/beego/v2/server/web"
+	"github.com/beego/beego/v2/server/web/context"
+)
+
+var (
+	// publicOrigin is scheme and host under which mail2web is reachable,
+	// e.g. “https://mails.example.com”.  If empty, it is taken from the
+	// request.
+	publicOrigin string
+	// prefixRegex matches valid values of X-Forwarded-Prefix, i.e. paths
+	// without anything that needs escaping in headers or HTML.
+	prefixRegex = regexp.MustCompile(`^(/[-A-Za-z0-9._~]+)*/?$`)
+)
+
+// stripRootURL is a filter chain which removes the root URL from the request
+// path, so that the routes match.  Requests without the root URL are served
+// as they are; this way, the reverse proxy may strip it itself.  All
+// handlers behind this filter see the path without the root URL.
+func stripRootURL(next web.FilterFunc) web.FilterFunc {
+	return func(ctx *context.Context) {
+		path := ctx.Request.URL.Path
+		if rootURL != "" && (path == rootURL || strings.HasPrefix(path, rootURL+"/")) {
+			ctx.Request.URL.Path = "/" + strings.TrimPrefix(path[len(rootURL):], "/")
+			ctx.Request.URL.RawPath = ""
+		}
+		next(ctx)
+	}
+}
+
+// basePath returns the path prefix under which the client sees mail2web, for
+// links in pages.  It is the X-Forwarded-Prefix header of the reverse proxy,
+// if valid and sent by a trusted proxy, or the root URL otherwise.  It never
+// ends with a slash.
+func basePath(ctx *context.Context) string {
+	if prefix := ctx.Input.Header("X-Forwarded-Prefix"); prefix != "" && prefixRegex.MatchString(prefix) &&
+		fromTrustedProxy(ctx) {
+		return strings.TrimSuffix(prefix, "/")
+	}
+	return rootURL
+}
+
+// requestScheme returns the scheme the client used, i.e. “http” or “https”.
+// X-Forwarded-Proto is only believed if sent by a trusted proxy.
+func requestScheme(ctx *context.Context) string {
+	if fromTrustedProxy(ctx) {
+		if scheme := ctx.Input.Header("X-Forwarded-Proto"); scheme == "http" || scheme == "https" {
+			return scheme
+		}
+	}
+	if ctx.Request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestOrigin returns scheme and host of mail2web, e.g.
+// “https://mails.example.com”.  Unless configured, they are taken from the
+// current request.  It is needed for absolute URLs.
+func requestOrigin(ctx *context.Context) string {
+	if publicOrigin != "" {
+		return publicOrigin
+	}
+	return requestScheme(ctx) + "://" + ctx.Request.Host
+}
+
+// publicRoot returns the absolute URL of mail2web’s root, without trailing
+// slash, e.g. “https://mails.example.com/mail2web”.  It is used for URLs in
+// feeds, mails, and API responses.
+func publicRoot(ctx *context.Context) string {
+	return requestOrigin(ctx) + basePath(ctx)
+}
+
+// mailRoot returns the URL of mail2web’s root for links in mails and in
+// other places where they are shown to other people than the client.
+// Therefore, the Host header is only used if the request comes from a trusted
+// proxy.  Otherwise, without a configured public origin, only the path is
+// returned.
+func mailRoot(ctx *context.Context) string {
+	if publicOrigin == "" && !fromTrustedProxy(ctx) {
+		return basePath(ctx)
+	}
+	return publicRoot(ctx)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/beego/beego/v2/server/web/context"
+)
+
+// withRootURL sets the root URL for the duration of the test.
+func withRootURL(t *testing.T, root string) {
+	oldRootURL := rootURL
+	rootURL = root
+	t.Cleanup(func() { rootURL = oldRootURL })
+}
+
+// forwardedRequest returns a request with the given X-Forwarded-Prefix and
+// X-Forwarded-Proto headers.  It comes from 192.0.2.1.
+func forwardedRequest(method, path, prefix, scheme string) *http.Request {
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set("X-Forwarded-Prefix", prefix)
+	request.Header.Set("X-Forwarded-Proto", scheme)
+	return request
+}
+
+func TestRootURLStripping(t *testing.T) {
+	withRootURL(t, "/mails")
+	hash := string(testHashID("reply1@example.com"))
+	for _, path := range []string{"/mails/" + hash, "/" + hash} {
+		response := serve(httptest.NewRequest(http.MethodGet, path, nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("%v: status %v", path, response.Code)
+		}
+		if !strings.Contains(response.Body.String(), `href="/mails/restricted/`+hash+`/send"`) {
+			t.Errorf("%v: links lack the root URL: %s", path, response.Body.Bytes())
+		}
+	}
+	if response := serve(httptest.NewRequest(http.MethodGet, "/mailsx/"+hash, nil)); response.Code != http.StatusNotFound {
+		t.Errorf("status %v for a path only starting with the root URL", response.Code)
+	}
+}
+
+func TestForwardedPrefix(t *testing.T) {
+	withRootURL(t, "/mails")
+	path := "/" + string(testHashID("reply1@example.com"))
+	response := serve(forwardedRequest(http.MethodGet, path, "/outer", "https"))
+	if strings.Contains(response.Body.String(), "/outer/") {
+		t.Errorf("X-Forwarded-Prefix of an untrusted client was used: %s", response.Body.Bytes())
+	}
+	withTrustedProxies(t, "192.0.2.0/24")
+	response = serve(forwardedRequest(http.MethodGet, path, "/outer", "https"))
+	if !strings.Contains(response.Body.String(), `href="/outer/restricted/`) {
+		t.Errorf("X-Forwarded-Prefix of a trusted proxy was ignored: %s", response.Body.Bytes())
+	}
+	response = serve(forwardedRequest(http.MethodGet, path, "/outer<script>", "https"))
+	if strings.Contains(response.Body.String(), "/outer") {
+		t.Errorf("invalid X-Forwarded-Prefix was used: %s", response.Body.Bytes())
+	}
+}
+
+func TestCookiePath(t *testing.T) {
+	withRootURL(t, "/mails")
+	setUpOIDCProvider(t)
+	for _, test := range []struct {
+		name    string
+		trusted bool
+		path    string
+		secure  bool
+	}{
+		{"untrusted", false, "/mails/", false},
+		{"trusted", true, "/outer/", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.trusted {
+				withTrustedProxies(t, "192.0.2.0/24")
+			}
+			response := serve(forwardedRequest(http.MethodGet, "/mails/auth/login", "/outer", "https"))
+			cookie := findCookie(response, oidcCookieName)
+			if cookie == nil {
+				t.Fatalf("no cookie: %v %s", response.Code, response.Body.Bytes())
+			}
+			if cookie.Path != test.path || cookie.Secure != test.secure {
+				t.Errorf("cookie path %q, secure %v", cookie.Path, cookie.Secure)
+			}
+		})
+	}
+}
+
+func TestRestrictedUnderRootURL(t *testing.T) {
+	withRootURL(t, "/mails")
+	for _, path := range []string{"/mails/restricted/my_mails", "/restricted/my_mails",
+		"/mails/api/v1/restricted/my_mails"} {
+		if response := serve(httptest.NewRequest(http.MethodGet, path, nil)); response.Code != http.StatusUnauthorized {
+			t.Errorf("%v: status %v without login", path, response.Code)
+		}
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.SetBasicAuth("alice", "")
+		if response := serve(request); response.Code != http.StatusOK {
+			t.Errorf("%v: status %v with login", path, response.Code)
+		}
+	}
+}
+
+func TestMailRoot(t *testing.T) {
+	withRootURL(t, "/mails")
+	mailRootFor := func() string {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Host = "attacker.example.com"
+		ctx := context.NewContext()
+		ctx.Reset(httptest.NewRecorder(), request)
+		return mailRoot(ctx)
+	}
+	if root := mailRootFor(); root != "/mails" {
+		t.Errorf("mail root %q uses the Host of an untrusted client", root)
+	}
+	publicOrigin = "https://mails.example.com"
+	if root := mailRootFor(); root != "https://mails.example.com/mails" {
+		t.Errorf("mail root %q ignores the public origin", root)
+	}
+	publicOrigin = ""
+	withTrustedProxies(t, "192.0.2.0/24")
+	if root := mailRootFor(); root != "http://attacker.example.com/mails" {
+		t.Errorf("mail root %q ignores the Host of a trusted proxy", root)
+	}
+}
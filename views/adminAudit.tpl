@@ -0,0 +1,46 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>Audit log</title>
+<style>
+  table {border: 1px solid}
+  td, th {border: 1px solid}
+</style>
+</head>
+<body>
+<h1>Audit log</h1>
+
+<form method="get">
+  <label>hash ID of any mail in the thread <input type="text" name="hash" value="{{.hash}}"></label>
+  <label>login <input type="text" name="login" value="{{.login}}"></label>
+  <button type="submit">Show</button>
+</form>
+
+{{if .hash}}
+<table>
+  <thead>
+    <tr><th>time</th><th>event</th><th>result</th><th>login</th><th>client</th><th>hash ID</th>
+      <th>access</th><th>message ID</th><th>attachment</th><th>reason</th></tr>
+  </thead>
+  <tbody>
+    {{range .records}}
+    <tr>
+      <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+      <td>{{.Event}}</td>
+      <td>{{.Result}}</td>
+      <td>{{.Login}}</td>
+      <td>{{.ClientIP}}<br><small>{{.UserAgent}}</small></td>
+      <td>{{.HashID}}</td>
+      <td>{{.AccessMode}}</td>
+      <td style="overflow-wrap: break-word; max-width: 20em">{{.MessageID}}</td>
+      <td>{{.Attachment}}</td>
+      <td>{{.Reason}}</td>
+    </tr>
+    {{else}}
+    <tr><td colspan="10">No accesses recorded.</td></tr>
+    {{end}}
+  </tbody>
+</table>
+{{end}}
+</body>
+</html>
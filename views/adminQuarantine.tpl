@@ -0,0 +1,36 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>Quarantined mails</title>
+<style>
+  table {border: 1px solid}
+  td, th {border: 1px solid}
+</style>
+</head>
+<body>
+<h1>Quarantined mails</h1>
+
+<p>These mails could not be indexed.  They are tried again every {{.retryInterval}}, except for
+  permanent failures, which are only tried again when the file changes.</p>
+
+<table>
+  <thead>
+    <tr><th>path</th><th>reason</th><th>permanent</th><th>since</th><th>last attempt</th><th>attempts</th></tr>
+  </thead>
+  <tbody>
+    {{range .mails}}
+    <tr>
+      <td>{{.Path}}</td>
+      <td>{{.Reason}}</td>
+      <td>{{if .Permanent}}yes{{else}}no{{end}}</td>
+      <td>{{.Since.Format "2006-01-02 15:04:05"}}</td>
+      <td>{{.LastAttempt.Format "2006-01-02 15:04:05"}}</td>
+      <td>{{.Attempts}}</td>
+    </tr>
+    {{else}}
+    <tr><td colspan="6">No mails in quarantine.</td></tr>
+    {{end}}
+  </tbody>
+</table>
+</body>
+</html>
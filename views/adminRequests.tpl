@@ -0,0 +1,51 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>Link requests</title>
+<style>
+  table {border: 1px solid}
+  td, th {border: 1px solid}
+</style>
+</head>
+<body>
+<h1>Link requests</h1>
+
+<table>
+  <thead>
+    <tr><th>date</th><th>user</th><th>message ID</th><th>status</th><th>decision</th></tr>
+  </thead>
+  <tbody>
+    {{range .requests}}
+    <tr id="{{.ID}}">
+      <td>{{.Created.Format "2006-01-02 15:04"}}</td>
+      <td>{{.Login}}</td>
+      <td style="overflow-wrap: break-word; max-width: 20em"><a href="{{$.rooturl}}/{{.CurrentHashID}}">{{.MessageID}}</a></td>
+      <td>{{.Status}}</td>
+      <td>
+        {{if eq .Status "pending"}}
+        <form method="post">
+          <input type="hidden" name="id" value="{{.ID}}">
+          <input type="hidden" name="csrf" value="{{$.csrf}}">
+          <label>access
+            <select name="mode">
+              <option value="single">only this mail</option>
+              <option value="direct">direct parent and children</option>
+              <option value="older" selected>thread up to this mail</option>
+              <option value="full">full thread</option>
+            </select>
+          </label>
+          <label>expires <input type="date" name="expires"></label>
+          <button type="submit" name="action" value="approve">Approve</button>
+          <button type="submit" name="action" value="deny">Deny</button>
+        </form>
+        {{else}}
+        {{.Decided.Format "2006-01-02 15:04"}}{{if .Mode}}, {{.Mode}}{{end}}{{if not .Expires.IsZero}},
+        until {{.Expires.Format "2006-01-02"}}{{end}}
+        {{end}}
+      </td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+</body>
+</html>
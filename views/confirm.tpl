@@ -0,0 +1,15 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>{{.title}}</title>
+</head>
+<body>
+<h1>{{.title}}</h1>
+
+<p>{{.question}}</p>
+<form method="post">
+  <input type="hidden" name="csrf" value="{{.csrf}}">
+  <button type="submit">{{.button}}</button>
+</form>
+</body>
+</html>
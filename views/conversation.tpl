@@ -0,0 +1,40 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>Conversation {{.subject}}</title>
+{{if .feedLink}}<link rel="alternate" type="application/atom+xml" title="Thread feed" href="{{.feedLink}}">{{end}}
+<style>
+  details.mail {border-top: 1px solid; padding: 6pt 0}
+  details.mail > summary {cursor: pointer}
+  .text {white-space: pre-wrap; font-family: monospace}
+  details.quote, details.signature {color: gray}
+</style>
+</head>
+<body>
+<h1>Conversation {{.subject}}</h1>
+
+<p><a href="{{.rooturl}}/{{.link}}{{.queryString}}">Back to the single mail view</a> |
+  <a href="{{.rooturl}}/{{.link}}{{.queryString}}&amp;view=conversation">chronological order</a> |
+  <a href="{{.rooturl}}/{{.link}}{{.queryString}}&amp;view=conversation&amp;order=tree">tree order</a></p>
+{{range $entry := .conversation}}
+<details class="mail" id="{{.Anchor}}"{{if .Current}} open{{end}}>
+  <summary><strong>{{.From}}:</strong> {{.Subject}} ({{.Date}})
+    <a href="{{$.rooturl}}/{{.Link}}{{$.queryString}}">#</a></summary>
+  {{if .HTML}}
+  <div style="max-width: 40em; margin-left: 18pt">
+  {{.HTML}}
+  </div>
+  {{else}}
+  <div class="text">{{.Text}}</div>
+  {{end}}
+  {{if .Attachments}}
+  <p>Attachments:
+  {{range $i, $name := .Attachments}}
+  <a href="{{$.rooturl}}/{{$entry.Link}}/{{$i}}{{$.queryString}}">{{$name}}</a>
+  {{end}}
+  </p>
+  {{end}}
+</details>
+{{end}}
+</body>
+</html>
@@ -0,0 +1,11 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>{{.status}} {{.title}}</title>
+</head>
+<body>
+<h1>{{.title}}</h1>
+
+<p>{{.message}}</p>
+</body>
+</html>
@@ -2,6 +2,11 @@
 <html lang="en">
 <head>
 <title>Mail {{.name}}</title>
+{{if .feedLink}}<link rel="alternate" type="application/atom+xml" title="Thread feed" href="{{.feedLink}}">{{end}}
+<style>
+  details.quote, details.signature {color: gray}
+  details > summary {cursor: pointer}
+</style>
 </head>
 <body>
 <h1>Mail {{.name}}</h1>
@@ -9,19 +14,37 @@
 <p><a href="{{.rooturl}}/restricted/{{.link}}/send">Send this to me!</a></p>
 <p><a href="{{.rooturl}}/restricted/my_mails">Show me my mails</a></p>
 {{if .thread}}
+<div id="thread">
 <h2>Thread</h2>
+<p><a href="{{.rooturl}}/{{.link}}{{.queryString}}&amp;view=conversation">Show all mails of the thread on one page</a></p>
+{{if .feedLink}}<p><a href="{{.feedLink}}">Subscribe to this thread (Atom feed)</a></p>
+<p>Notify me about new mails in this thread by email:
+  <a href="{{.rooturl}}/restricted/{{.link}}/subscribe{{.queryString}}">immediately</a> |
+  <a href="{{.rooturl}}/restricted/{{.link}}/subscribe{{.queryString}}&amp;mode=digest">daily digest</a> |
+  <a href="{{.rooturl}}/restricted/{{.link}}/unsubscribe{{.queryString}}">stop</a></p>{{end}}
 <ul>
   <li>
-    {{if .thread.Link}}
-    <a href="{{.thread.RootURL}}/{{.thread.Link}}"><strong>{{.thread.From}}:</strong> {{.thread.Subject}}</a>
-    {{else}}
-    <strong>{{.thread.From}}:</strong> {{.thread.Subject}}
-    {{end}}
+    {{template "threadNode.tpl" .thread}}
   </li>
   <ul>
     {{template "thread.tpl" .thread}}
   </ul>
 </ul>
+</div>
+{{if .eventsLink}}
+<script>
+  // Re-fetch this page and replace the thread list whenever the thread
+  // changes.
+  async function refreshThread() {
+    const response = await fetch(location.href);
+    const page = new DOMParser().parseFromString(await response.text(), "text/html");
+    document.getElementById("thread").replaceWith(page.getElementById("thread"));
+  }
+  const events = new EventSource({{.eventsLink}});
+  events.addEventListener("added", refreshThread);
+  events.addEventListener("removed", refreshThread);
+</script>
+{{end}}
 {{end}}
 <h2>Mail content</h2>
 <table border="1">
@@ -54,9 +77,7 @@
 {{.html}}
 </div>
 {{else}}
-<pre style="white-space: pre-wrap">
-{{.text}}
-</pre>
+<div style="white-space: pre-wrap; font-family: monospace">{{.text}}</div>
 {{end}}
 {{if .attachments}}
 <h2>Attachments</h2>
@@ -6,8 +6,19 @@
 <body>
 <h1>Mail request</h1>
 
+{{if .link}}
+<p>The links for the mail with the message ID</p>
+<pre>{{.messageid}}</pre>
+<p>are:</p>
+<ul>
+  <li><a href="{{.link}}">only this mail</a></li>
+  <li><a href="{{.fullThreadLink}}">this mail with its full thread</a></li>
+</ul>
+{{else}}
 <p>Your mail URL request for the mail with the message ID</p>
 <pre>{{.messageid}}</pre>
-<p>was sent to the administrator.</p>
+<p>was sent to the administrator.  You will receive the link by mail as soon
+  as the request is approved.</p>
+{{end}}
 </body>
 </html>
@@ -10,25 +10,63 @@
 <body>
 <h1>Your mails</h1>
 
-<p>The following table shows all your mails of the last 30 days.</p>
+<p>The following table shows your mails{{if not (or .since .until)}} of the last {{.windowDays}} days{{end}}.</p>
 <p>This includes mails where the mail address(es) {{.addresses}} occur(s) in
   “<samp>From:</samp>”, “<samp>To:</samp>”, “<samp>Cc:</samp>”, or
   “<samp>Bcc:</samp>”.</p>
 
+<form method="get">
+  <label>from <input type="date" name="since" value="{{.since}}"></label>
+  <label>until <input type="date" name="until" value="{{.until}}"></label>
+  <label>folder
+    <select name="folder">
+      <option value="">all</option>
+      {{range .folders}}
+      <option{{if eq . $.folder}} selected{{end}}>{{.}}</option>
+      {{end}}
+    </select>
+  </label>
+  <label>sender <input type="text" name="sender" value="{{.sender}}"></label>
+  <label><input type="checkbox" name="attachments" value="1"{{if .attachmentsOnly}} checked{{end}}>
+    with attachments only</label>
+  <label>sort by
+    <select name="sort">
+      <option value="date"{{if eq .sort "date"}} selected{{end}}>date</option>
+      <option value="from"{{if eq .sort "from"}} selected{{end}}>from</option>
+      <option value="subject"{{if eq .sort "subject"}} selected{{end}}>subject</option>
+    </select>
+  </label>
+  <label>
+    <select name="order">
+      <option value="desc">descending</option>
+      <option value="asc"{{if .ascending}} selected{{end}}>ascending</option>
+    </select>
+  </label>
+  <button type="submit">Show</button>
+</form>
+
 <table>
   <thead>
-    <tr><th>date</th><th>from</th><th>subject</th><th>message ID</th></tr>
+    <tr><th>date</th><th>from</th><th>subject</th><th>folder</th><th>matched</th><th>attachments</th><th>message ID</th></tr>
   </thead>
   <tbody>
     {{range .rows}}
     <tr>
-      <td><a href="{{.FullThreadLink}}">{{.Timestamp}}</a></td>
+      <td><a href="{{.FullThreadLink $.rooturl}}">{{.Timestamp}}</a></td>
       <td>{{.From}}</td>
       <td>{{.Subject}}</td>
+      <td>{{.Folder}}</td>
+      <td>{{range $i, $match := .Matches}}{{if $i}}<br>{{end}}{{$match.Address}} ({{range $j, $role := $match.Roles}}{{if $j}}, {{end}}{{$role}}{{end}}){{end}}</td>
+      <td>{{if .HasAttachments}}📎{{end}}</td>
       <td style="overflow-wrap: break-word; max-width: 20em">{{.MessageID}}</td>
     </tr>
     {{end}}
   </tbody>
 </table>
+<p>
+  {{if .previousPage}}<a href="{{.previousPage}}">previous page</a>{{end}}
+  page {{.page}}
+  {{if .nextPage}}<a href="{{.nextPage}}">next page</a>{{end}}
+</p>
 </body>
 </html>
@@ -0,0 +1,17 @@
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<title>Thread notifications</title>
+</head>
+<body>
+<h1>Thread notifications</h1>
+
+{{if .subscribed}}
+<p>You follow <a href="{{.rooturl}}/{{.link}}">this thread</a> now.
+  {{if .digest}}A daily digest{{else}}A notification{{end}} about new mails will
+  be sent to {{.address}}.</p>
+{{else}}
+<p>You don’t follow <a href="{{.rooturl}}/{{.link}}">this thread</a> anymore.</p>
+{{end}}
+</body>
+</html>
@@ -1,10 +1,6 @@
 {{range .Children}}
 <li>
-  {{if .Link}}
-  <a href="{{.RootURL}}/{{.Link}}"><strong>{{.From}}:</strong> {{.Subject}}</a>
-  {{else}}
-  <strong>{{.From}}:</strong> {{.Subject}}
-  {{end}}
+  {{template "threadNode.tpl" .}}
 </li>
 <ul>{{template "thread.tpl" .}}</ul>
 {{end}}
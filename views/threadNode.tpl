@@ -0,0 +1,5 @@
+{{if .Link}}<a href="{{.RootURL}}/{{.Link}}">{{end}}<strong>{{.FromName}}</strong>{{if not .RepeatedSubject}}: {{.Subject}}{{end}}{{if .Link}}</a>{{end}}
+{{if .Missing}}<em>(missing from archive)</em>{{end}}
+{{if not .Date.IsZero}}<small title="{{.Date.Format "2006-01-02 15:04 -0700"}}">{{relativeTime .Date}}</small>{{end}}
+{{if .HasAttachments}}<small title="has attachments">📎</small>{{end}}
+{{if .Origin}}<small>(origin mail)</small>{{end}}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// webhook is the configuration of one outgoing webhook in permissions.yaml.
+// It fires for mails added to or removed from one of the threads given by any
+// of their hash IDs (typically the one of the root), and for mails with one of
+// the given addresses in “From”, “To”, “Cc”, or “Bcc”.  The hash IDs may have
+// been made with an old key or another hash length.
+type webhook struct {
+	URL       string
+	Secret    string
+	Threads   []hashID
+	Addresses []string
+}
+
+// matches returns whether the webhook should fire for the given event.
+func (webhook webhook) matches(event threadEvent) bool {
+	for _, thread := range webhook.Threads {
+		if event.thread[currentHashID(thread)] {
+			return true
+		}
+	}
+	for _, address := range webhook.Addresses {
+		if event.addresses[strings.ToLower(address)] {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the JSON body sent to webhooks.
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	ThreadRoot hashID    `json:"threadRoot"`
+	HashID     hashID    `json:"hashID"`
+	MessageID  messageID `json:"messageID,omitempty"`
+	From       string    `json:"from,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	Date       time.Time `json:"date"`
+}
+
+// webhookDelivery is one pending delivery in the persistent queue.  Each
+// delivery is stored as a JSON file in webhooksQueuePath.
+type webhookDelivery struct {
+	ID          string
+	URL         string
+	Secret      string
+	Event       string
+	Payload     json.RawMessage
+	Attempts    int
+	NextAttempt time.Time
+}
+
+const (
+	webhookMaxAttempts  = 10
+	webhookInitialDelay = 10 * time.Second
+	webhookMaxDelay     = 6 * time.Hour
+	webhookPollInterval = 5 * time.Second
+)
+
+var (
+	webhooksQueuePath string
+	webhookClient     = &http.Client{Timeout: 10 * time.Second}
+)
+
+// webhooksConfigured returns whether there are webhooks at all.
+func webhooksConfigured() bool {
+	permissionsLock.RLock()
+	defer permissionsLock.RUnlock()
+	return len(permissions.Webhooks) > 0
+}
+
+// queueWebhooks writes deliveries for all webhooks matching the given event to
+// the persistent queue.  It is called by runThreadEventQueue.  The deliveries
+// are sent by runWebhookDeliveries.
+func queueWebhooks(event threadEvent) {
+	var payload []byte
+	name := "added"
+	if event.removed {
+		name = "removed"
+	}
+	permissionsLock.RLock()
+	webhooks := permissions.Webhooks
+	permissionsLock.RUnlock()
+	for _, webhook := range webhooks {
+		if !webhook.matches(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(webhookPayload{
+				Event:      name,
+				ThreadRoot: findThreadRootByHashID(event.HashID),
+				HashID:     event.HashID,
+				MessageID:  event.MessageID,
+				From:       event.From,
+				Subject:    event.Subject,
+				Date:       event.Timestamp,
+			})
+			check(err)
+		}
+		randomBytes := make([]byte, 8)
+		_, err := rand.Read(randomBytes)
+		check(err)
+		delivery := webhookDelivery{
+			ID:          fmt.Sprintf("%d-%x", time.Now().UnixNano(), randomBytes),
+			URL:         webhook.URL,
+			Secret:      webhook.Secret,
+			Event:       name,
+			Payload:     payload,
+			NextAttempt: time.Now(),
+		}
+		if err := writeWebhookDelivery(delivery); err != nil {
+			logger.Println("Could not queue webhook delivery:", err)
+		}
+	}
+}
+
+// writeWebhookDelivery stores the given delivery in the queue directory.  The
+// file is written atomically.
+func writeWebhookDelivery(delivery webhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(webhooksQueuePath, delivery.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// sendWebhook makes one attempt to deliver the given delivery.  The body is
+// signed with HMAC-SHA256 using the webhook’s secret.
+func sendWebhook(delivery webhookDelivery) error {
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(delivery.Secret))
+	mac.Write(delivery.Payload)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Mail2web-Event", delivery.Event)
+	request.Header.Set("X-Mail2web-Delivery", delivery.ID)
+	request.Header.Set("X-Mail2web-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook %v returned HTTP %v", delivery.URL, response.StatusCode)
+	}
+	return nil
+}
+
+// processWebhookQueue attempts all due deliveries in the queue once.
+// Successful deliveries are removed from the queue.  Failed ones are retried
+// with exponential backoff, and dropped after webhookMaxAttempts attempts.
+func processWebhookQueue() {
+	paths, err := filepath.Glob(filepath.Join(webhooksQueuePath, "*.json"))
+	check(err)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		check(err)
+		var delivery webhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			logger.Println("Removing invalid webhook delivery", path)
+			check(os.Remove(path))
+			continue
+		}
+		if time.Now().Before(delivery.NextAttempt) {
+			continue
+		}
+		err = sendWebhook(delivery)
+		delivery.Attempts++
+		if err == nil {
+			check(os.Remove(path))
+			continue
+		}
+		if delivery.Attempts >= webhookMaxAttempts {
+			logger.Printf("Giving up webhook delivery %v after %v attempts: %v", delivery.ID, delivery.Attempts, err)
+			check(os.Remove(path))
+			continue
+		}
+		delay := webhookInitialDelay << (delivery.Attempts - 1)
+		if delay > webhookMaxDelay {
+			delay = webhookMaxDelay
+		}
+		delivery.NextAttempt = time.Now().Add(delay)
+		logger.Printf("Webhook delivery %v failed, retrying in %v: %v", delivery.ID, delay, err)
+		check(writeWebhookDelivery(delivery))
+	}
+}
+
+// runWebhookDeliveries is a goroutine running for the whole run time of the
+// program.  It periodically sends the deliveries in the queue.  Since the
+// queue is persistent, deliveries survive restarts.
+func runWebhookDeliveries() {
+	for {
+		processWebhookQueue()
+		time.Sleep(webhookPollInterval)
+	}
+}
+
+// setUpWebhookQueue creates the directory of the webhook delivery queue.
+func setUpWebhookQueue(config *config) {
+	webhooksQueuePath = filepath.Join(config.StatePath, "webhooks")
+	err := os.MkdirAll(webhooksQueuePath, 0o700)
+	check(err)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local stand-in for a webhook endpoint.  It checks the
+// signature of every request and records the payloads.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	status   int
+	payloads chan webhookPayload
+}
+
+func (receiver *webhookReceiver) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		receiver.t.Error(err)
+	}
+	mac := hmac.New(sha256.New, []byte(receiver.secret))
+	mac.Write(body)
+	if signature := request.Header.Get("X-Mail2web-Signature"); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		receiver.t.Errorf("invalid signature %q", signature)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		receiver.t.Errorf("invalid payload %s: %v", body, err)
+	}
+	if request.Header.Get("X-Mail2web-Event") != payload.Event {
+		receiver.t.Errorf("event header %q does not match payload", request.Header.Get("X-Mail2web-Event"))
+	}
+	receiver.payloads <- payload
+	writer.WriteHeader(receiver.status)
+}
+
+// setUpWebhookReceiver starts a webhook stand-in answering with the given
+// status code and configures a webhook for it.  The webhook queue is put into
+// a temporary directory.
+func setUpWebhookReceiver(t *testing.T, status int, configured webhook) *webhookReceiver {
+	receiver := &webhookReceiver{t: t, secret: "webhook secret", status: status,
+		payloads: make(chan webhookPayload, 10)}
+	server := httptest.NewServer(receiver)
+	configured.URL, configured.Secret = server.URL, receiver.secret
+	oldQueuePath := webhooksQueuePath
+	webhooksQueuePath = t.TempDir()
+	permissionsLock.Lock()
+	permissions.Webhooks = []webhook{configured}
+	permissionsLock.Unlock()
+	t.Cleanup(func() {
+		permissionsLock.Lock()
+		permissions.Webhooks = nil
+		permissionsLock.Unlock()
+		webhooksQueuePath = oldQueuePath
+		server.Close()
+	})
+	return receiver
+}
+
+// queuedDeliveries returns the deliveries in the webhook queue.
+func queuedDeliveries(t *testing.T) (deliveries []webhookDelivery) {
+	paths, err := filepath.Glob(filepath.Join(webhooksQueuePath, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delivery webhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return
+}
+
+func TestWebhookForNewThread(t *testing.T) {
+	receiver := setUpWebhookReceiver(t, http.StatusNoContent, webhook{Addresses: []string{"Dave@example.com"}})
+	mail := testMail{"100", "new-thread@example.com", "Dave <dave@example.com>", "Fri, 05 Jan 2024 10:00:00 +0000",
+		"", "New topic"}
+	writeTestMail(filepath.Join(mailDir, "inbox"), mail)
+	path := filepath.Join(mailDir, "inbox", mail.file)
+	hash := testHashID(messageID(mail.messageID))
+	t.Cleanup(func() {
+		check(os.Remove(path))
+		unindexMail(hash)
+	})
+	indexMail(path, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queuedDeliveries(t)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no webhook delivery queued for the new mail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	processWebhookQueue()
+	select {
+	case payload := <-receiver.payloads:
+		if payload.Event != "added" || payload.HashID != hash || payload.ThreadRoot != hash ||
+			payload.MessageID != messageID(mail.messageID) || payload.Subject != "New topic" {
+			t.Errorf("wrong payload %+v", payload)
+		}
+	default:
+		t.Fatal("webhook was not called")
+	}
+	if deliveries := queuedDeliveries(t); len(deliveries) != 0 {
+		t.Errorf("delivery was not removed from the queue: %+v", deliveries)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver := setUpWebhookReceiver(t, http.StatusInternalServerError,
+		webhook{Threads: []hashID{testHashID("root@example.com")}})
+	hash := testHashID("reply3@example.com")
+	mailInfosLock.RLock()
+	event := threadEvent{mailInfo: mailInfos[hash], thread: collectThread(hash)}
+	mailInfosLock.RUnlock()
+	queueWebhooks(threadEvent{mailInfo: mailInfos[testHashID("root@example.com")],
+		thread: map[hashID]bool{"other": true}})
+	if deliveries := queuedDeliveries(t); len(deliveries) != 0 {
+		t.Fatalf("delivery for other thread queued: %+v", deliveries)
+	}
+	queueWebhooks(event)
+	processWebhookQueue()
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("webhook was called %v times", len(receiver.payloads))
+	}
+	deliveries := queuedDeliveries(t)
+	if len(deliveries) != 1 || deliveries[0].Attempts != 1 || !deliveries[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("failed delivery not rescheduled: %+v", deliveries)
+	}
+	processWebhookQueue()
+	if len(receiver.payloads) != 1 {
+		t.Errorf("delivery was retried before it was due")
+	}
+}